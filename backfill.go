@@ -0,0 +1,441 @@
+package chompy
+
+import (
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// At most this many pull requests are backfilled at once.
+const maxBackfillPulls = 300
+
+// A BackfillJob grants the credits that a repository's past pull requests
+// would have earned through the webhook.  It's previewed before granting.
+type BackfillJob struct {
+	Repo    string // owner/name
+	Since   time.Time
+	Started time.Time
+	By      string
+	Host    string // for the links in reward emails
+
+	Status string          // previewing, ready, granting, done or failed
+	Error  string          `datastore:",noindex"`
+	Pulls  int             // merged pull requests found
+	Grants []BackfillGrant `datastore:",noindex"`
+}
+
+const (
+	BackfillPreviewing = "previewing"
+	BackfillReady      = "ready"
+	BackfillGranting   = "granting"
+	BackfillDone       = "done"
+	BackfillFailed     = "failed"
+)
+
+// A BackfillGrant is a credit a pull request earned someone, or would have if
+// it weren't for Skipped.
+type BackfillGrant struct {
+	PullRequest string // html url
+	Login       string
+	Email       string
+	Type        string // pull-request-merged or pull-request-reviewed
+	Credits     int
+	Skipped     string // why it isn't granted
+	Granted     bool   // by this backfill
+}
+
+// Pending returns whether the credit is still to be granted.
+func (g BackfillGrant) Pending() bool { return g.Skipped == "" && !g.Granted }
+
+// Pending counts the credits still to be granted.
+func (job BackfillJob) Pending() int {
+	n := 0
+	for _, g := range job.Grants {
+		if g.Pending() {
+			n += g.Credits
+		}
+	}
+	return n
+}
+
+func (job BackfillJob) Running() bool {
+	return job.Status == BackfillPreviewing || job.Status == BackfillGranting
+}
+
+type BackfillJobId int64
+
+func (id BackfillJobId) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "backfill_jobs", "", int64(id), nil)
+}
+
+// BackfillJobEntry pairs a job with its id for rendering.
+type BackfillJobEntry struct {
+	Id BackfillJobId
+	BackfillJob
+}
+
+func (cfg Configuration) lookGithubUser(login string) *GithubUserInfo {
+	for _, user := range cfg.GithubUsers {
+		if strings.EqualFold(user.Username, login) {
+			return &user
+		}
+	}
+	return nil
+}
+
+// planBackfill applies the webhook handlers' rules to a merged pull request
+// of repo, returning what it earned whom.  sameTeam reports whether two
+// github users share a team.
+func (cfg Configuration) planBackfill(repo string, pr githubPull, reviews []githubReview,
+	comments []githubComment, sameTeam func(a, b string) bool) []BackfillGrant {
+	settings := cfg.githubRepo(repo)
+	grant := func(login, typ string) BackfillGrant {
+		g := BackfillGrant{PullRequest: pr.HtmlUrl, Login: login, Type: typ, Credits: settings.credits()}
+		if user := cfg.lookGithubUser(login); user != nil {
+			g.Email = user.Email
+		} else {
+			g.Skipped = "github user not configured"
+		}
+		if !settings.rewards(typ) {
+			g.Skipped = fmt.Sprintf("%s isn't rewarded for this repository", typ)
+		}
+		return g
+	}
+
+	author := grant(pr.User.Login, "pull-request-merged")
+	var labels []string
+	for _, label := range pr.Labels {
+		labels = append(labels, label.Name)
+	}
+	if why := cfg.githubExcluded(repo, pr.Base.Ref, labels); why != "" {
+		author.Skipped = why
+		return []BackfillGrant{author}
+	}
+	if !settings.branchAllowed(pr.Base.Ref) {
+		author.Skipped = fmt.Sprintf("branch %s doesn't count", pr.Base.Ref)
+		return []BackfillGrant{author}
+	}
+
+	// Collect reviews as the review webhooks would have.
+	records := map[string]*ReviewRecord{}
+	record := func(user githubUser) *ReviewRecord {
+		if strings.EqualFold(user.Login, pr.User.Login) || cfg.isGithubBot(user.Login, user.Type) {
+			return nil
+		}
+		login := strings.ToLower(user.Login)
+		if records[login] == nil {
+			records[login] = &ReviewRecord{PullRequest: pr.HtmlUrl, Reviewer: user.Login}
+		}
+		return records[login]
+	}
+	for _, review := range reviews {
+		rev := record(review.User)
+		if rev == nil || review.SubmittedAt.After(*pr.MergedAt) {
+			continue
+		}
+		switch review.State {
+		case "APPROVED":
+			rev.Approved = true
+		case "DISMISSED":
+			rev.Approved = false
+		}
+		if strings.TrimSpace(review.Body) != "" {
+			rev.countComment(review.Id)
+		}
+	}
+	for _, comment := range comments {
+		if rev := record(comment.User); rev != nil && !comment.CreatedAt.After(*pr.MergedAt) {
+			rev.countComment(comment.Id)
+		}
+	}
+
+	var grants []BackfillGrant
+	approved := false
+	lines := pr.Additions + pr.Deletions
+	for _, rev := range records {
+		approved = approved || rev.Approved
+		g := grant(rev.Reviewer, "pull-request-reviewed")
+		if ok, why := cfg.reviewCredited(*rev, lines, sameTeam(rev.Reviewer, pr.User.Login)); !ok && g.Skipped == "" {
+			g.Skipped = why
+		}
+		// Don't list everyone who commented without approving.
+		if rev.Approved {
+			grants = append(grants, g)
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Login < grants[j].Login })
+
+	if cfg.isGithubBot(pr.User.Login, pr.User.Type) {
+		author.Skipped = "bot"
+	} else if author.Skipped == "" && cfg.GithubRequireApproval && !approved {
+		author.Skipped = "nobody approved it"
+	}
+	return append([]BackfillGrant{author}, grants...)
+}
+
+// collectBackfill pages through repo's pull requests merged since the given
+// time and plans what they earned.  It returns how many there were too.
+func (cfg Configuration) collectBackfill(gh githubClient, repo string, since time.Time,
+	sameTeam func(a, b string) bool) ([]BackfillGrant, int, error) {
+	pulls, err := gh.mergedPulls(repo, since, maxBackfillPulls)
+	if err != nil {
+		return nil, 0, err
+	}
+	var grants []BackfillGrant
+	for _, pr := range pulls {
+		if cfg.ReviewTrivialLines > 0 {
+			// Only single pull requests say how big they are.
+			details, err := gh.pull(repo, pr.Number)
+			if err != nil {
+				return nil, 0, err
+			}
+			pr.Additions, pr.Deletions = details.Additions, details.Deletions
+		}
+		reviews, err := gh.reviews(repo, pr.Number)
+		if err != nil {
+			return nil, 0, err
+		}
+		var comments []githubComment
+		if cfg.ReviewMinComments > 0 {
+			if comments, err = gh.reviewComments(repo, pr.Number); err != nil {
+				return nil, 0, err
+			}
+		}
+		grants = append(grants, cfg.planBackfill(repo, pr, reviews, comments, sameTeam)...)
+	}
+	return grants, len(pulls), nil
+}
+
+func loadBackfillJob(c context.Context, id BackfillJobId) (BackfillJob, error) {
+	var job BackfillJob
+	err := datastore.Get(c, id.Key(c), &job)
+	return job, err
+}
+
+var backfillPreviewLater = delay.Func("backfill-preview", func(c context.Context, id BackfillJobId) error {
+	job, err := loadBackfillJob(c, id)
+	if err != nil {
+		return err
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		return err
+	}
+
+	emails := map[string]string{} // github login -> parsed email
+	for _, u := range cfg.GithubUsers {
+		if addr, err := netmail.ParseAddress(cleanEmail(u.Email)); err == nil {
+			emails[strings.ToLower(u.Username)] = addr.Address
+		}
+	}
+	sameTeam := func(a, b string) bool {
+		ea, eb := emails[strings.ToLower(a)], emails[strings.ToLower(b)]
+		if cfg.ReviewTrivialLines == 0 || ea == "" || eb == "" {
+			return false
+		}
+		same, err := shareTeam(c, ea, eb)
+		if err != nil {
+			log.Errorf(c, "Failed to load teams of %q: %v", a, err)
+		}
+		return same
+	}
+
+	gh := githubClient{urlfetch.Client(c), githubAPI, cfg.GithubToken}
+	job.Grants, job.Pulls, err = cfg.collectBackfill(gh, job.Repo, job.Since, sameTeam)
+	job.Status = BackfillReady
+	if err != nil {
+		log.Errorf(c, "Backfill %d of %s failed: %v", id, job.Repo, err)
+		job.Status, job.Error = BackfillFailed, err.Error()
+	}
+	// Don't grant what's already been granted, e.g. by the webhook.
+	for i, g := range job.Grants {
+		if g.Skipped != "" {
+			continue
+		}
+		uid := Reward{Email: cleanEmail(g.Email), Type: g.Type, Description: g.PullRequest}.Uid()
+		if err := datastore.Get(c, uid.Key(c), &Reward{}); err == nil {
+			job.Grants[i].Skipped = "already granted"
+		}
+	}
+	_, err = datastore.Put(c, id.Key(c), &job)
+	return err
+})
+
+var backfillGrantLater = delay.Func("backfill-grant", func(c context.Context, id BackfillJobId) error {
+	job, err := loadBackfillJob(c, id)
+	if err != nil {
+		return err
+	}
+	// Grant as if the request came from the admin who started the job.
+	r := &http.Request{Host: job.Host, RemoteAddr: "backfill", URL: &url.URL{Path: "/backfill"}, Header: http.Header{}}
+	for i, g := range job.Grants {
+		if !g.Pending() {
+			continue
+		}
+		code, err := grantRewards(c, r, g.Email, g.Type, g.PullRequest, g.Credits)
+		if err != nil && code != http.StatusConflict {
+			log.Errorf(c, "Backfill %d failed to grant %#v: %v", id, g, err)
+			job.Status, job.Error = BackfillFailed, err.Error()
+			break
+		}
+		job.Grants[i].Granted = true
+	}
+	if job.Status == BackfillGranting {
+		job.Status = BackfillDone
+	}
+	_, err = datastore.Put(c, id.Key(c), &job)
+	return err
+})
+
+// ShowBackfills lists backfill jobs, with a form to start one.
+func ShowBackfills(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	var jobs []BackfillJob
+	keys, err := datastore.NewQuery("backfill_jobs").Order("-Started").Limit(50).GetAll(c, &jobs)
+	if err != nil {
+		log.Criticalf(c, "Failed to load backfill jobs: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	var entries []BackfillJobEntry
+	for i, key := range keys {
+		entries = append(entries, BackfillJobEntry{BackfillJobId(key.IntID()), jobs[i]})
+	}
+	params := struct {
+		Jobs  []BackfillJobEntry
+		Since time.Time
+	}{entries, time.Now().AddDate(0, -3, 0)}
+	if err := backfillHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render backfill template: %v", err)
+	}
+}
+
+// StartBackfill starts previewing a backfill of a repository.
+func StartBackfill(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	repo := strings.TrimSpace(r.FormValue("repo"))
+	if strings.Count(repo, "/") != 1 || strings.ContainsAny(repo, " ?#") {
+		http.Error(w, "The repository should be like owner/name", http.StatusBadRequest)
+		return
+	}
+	since, err := time.Parse("2006-01-02", r.FormValue("since"))
+	if err != nil {
+		http.Error(w, "Bad date: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	job := BackfillJob{
+		Repo:    repo,
+		Since:   since,
+		Started: time.Now(),
+		By:      u.Email,
+		Host:    r.Host,
+		Status:  BackfillPreviewing,
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "backfill_jobs", nil), &job)
+	if err == nil {
+		err = backfillPreviewLater.Call(c, BackfillJobId(key.IntID()))
+	}
+	if err != nil {
+		log.Criticalf(c, "Failed to start backfill of %s: %v", repo, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q started backfill %d of %s since %v", u.Email, key.IntID(), repo, since)
+	http.Redirect(w, r, fmt.Sprintf("/backfill/%d", key.IntID()), http.StatusSeeOther)
+}
+
+func backfillJobId(w http.ResponseWriter, r *http.Request, p martini.Params) (BackfillJobId, bool) {
+	n, err := strconv.ParseInt(p["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	return BackfillJobId(n), true
+}
+
+// ShowBackfill shows a backfill job's preview or results.
+func ShowBackfill(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	id, ok := backfillJobId(w, r, p)
+	if !ok {
+		return
+	}
+	job, err := loadBackfillJob(c, id)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to load backfill %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := backfillJobHtmlTpl.Execute(w, BackfillJobEntry{id, job}); err != nil {
+		log.Criticalf(c, "Failed to render backfill job template: %v", err)
+	}
+}
+
+// GrantBackfill grants the credits a backfill job previewed.
+func GrantBackfill(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	id, ok := backfillJobId(w, r, p)
+	if !ok {
+		return
+	}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		job, err := loadBackfillJob(c, id)
+		if err != nil {
+			return err
+		}
+		if job.Status != BackfillReady {
+			return errNotAvailable
+		}
+		job.Status = BackfillGranting
+		if _, err := datastore.Put(c, id.Key(c), &job); err != nil {
+			return err
+		}
+		return backfillGrantLater.Call(c, id)
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err == errNotAvailable {
+		http.Error(w, "This backfill isn't ready to grant", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to start granting backfill %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q is granting backfill %d", u.Email, id)
+	http.Redirect(w, r, fmt.Sprintf("/backfill/%d", id), http.StatusSeeOther)
+}
@@ -0,0 +1,117 @@
+package chompy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGithub serves a repository's pull requests and reviews like the GitHub
+// REST API, two pull requests per page.
+func fakeGithub(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	pages := []string{
+		`[{"number":4,"html_url":"https://github.com/acme/app/pull/4","user":{"login":"alice","type":"User"},
+		   "merged_at":"2017-05-04T00:00:00Z","updated_at":"2017-05-04T00:00:00Z","base":{"ref":"master"}},
+		  {"number":3,"html_url":"https://github.com/acme/app/pull/3","user":{"login":"bob","type":"User"},
+		   "merged_at":null,"updated_at":"2017-05-03T00:00:00Z","base":{"ref":"master"}}]`,
+		`[{"number":2,"html_url":"https://github.com/acme/app/pull/2","user":{"login":"dependabot[bot]","type":"Bot"},
+		   "merged_at":"2017-05-02T00:00:00Z","updated_at":"2017-05-02T00:00:00Z","base":{"ref":"master"}},
+		  {"number":1,"html_url":"https://github.com/acme/app/pull/1","user":{"login":"bob","type":"User"},
+		   "merged_at":"2017-04-01T00:00:00Z","updated_at":"2017-04-01T00:00:00Z","base":{"ref":"master"}}]`,
+	}
+	reviews := map[string]string{
+		"4": `[{"id":40,"user":{"login":"bob"},"state":"APPROVED","body":"LGTM","submitted_at":"2017-05-03T00:00:00Z"},
+		       {"id":41,"user":{"login":"carol"},"state":"COMMENTED","body":"hmm","submitted_at":"2017-05-03T00:00:00Z"},
+		       {"id":42,"user":{"login":"dave"},"state":"APPROVED","body":"","submitted_at":"2017-05-05T00:00:00Z"}]`,
+		"2": `[{"id":20,"user":{"login":"bob"},"state":"APPROVED","body":"","submitted_at":"2017-05-01T00:00:00Z"}]`,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/acme/app/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		page := 0
+		if r.FormValue("page") == "2" {
+			page = 1
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/acme/app/pulls?page=2>; rel="next", <%[1]s/repos/acme/app/pulls?page=2>; rel="last"`, server.URL))
+		}
+		fmt.Fprint(w, pages[page])
+	})
+	mux.HandleFunc("/repos/acme/app/pulls/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/repos/acme/app/pulls/"), "/")
+		switch {
+		case len(parts) == 2 && parts[1] == "reviews" && reviews[parts[0]] != "":
+			fmt.Fprint(w, reviews[parts[0]])
+		case len(parts) == 2 && parts[1] == "reviews":
+			fmt.Fprint(w, "[]")
+		default:
+			t.Errorf("Unexpected request: %s", r.URL)
+			http.NotFound(w, r)
+		}
+	})
+	server = httptest.NewServer(mux)
+	return server
+}
+
+func TestCollectBackfill(t *testing.T) {
+	server := fakeGithub(t)
+	defer server.Close()
+	gh := githubClient{http.DefaultClient, server.URL, "secret"}
+
+	cfg := Configuration{GithubUsers: []GithubUserInfo{
+		{Username: "alice", Email: "alice@acme.com"},
+		{Username: "bob", Email: "Bob (bob@acme.com)"},
+		{Username: "dave", Email: "dave@acme.com"},
+	}}
+	since := time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)
+	grants, pulls, err := cfg.collectBackfill(gh, "acme/app", since, func(a, b string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pulls != 2 {
+		t.Errorf("Got %d merged pull requests, want 2", pulls)
+	}
+	want := []BackfillGrant{
+		{PullRequest: "https://github.com/acme/app/pull/4", Login: "alice", Email: "alice@acme.com",
+			Type: "pull-request-merged", Credits: 1},
+		// carol didn't approve and dave approved after it was merged.
+		{PullRequest: "https://github.com/acme/app/pull/4", Login: "bob", Email: "Bob (bob@acme.com)",
+			Type: "pull-request-reviewed", Credits: 1},
+		{PullRequest: "https://github.com/acme/app/pull/2", Login: "dependabot[bot]",
+			Type: "pull-request-merged", Credits: 1, Skipped: "bot"},
+		{PullRequest: "https://github.com/acme/app/pull/2", Login: "bob", Email: "Bob (bob@acme.com)",
+			Type: "pull-request-reviewed", Credits: 1},
+	}
+	if !reflect.DeepEqual(grants, want) {
+		t.Errorf("Wrong grants:\n got %#v\nwant %#v", grants, want)
+	}
+}
+
+func TestPlanBackfillIgnoresLateComments(t *testing.T) {
+	merged := time.Date(2017, 5, 4, 0, 0, 0, 0, time.UTC)
+	pr := githubPull{HtmlUrl: "https://github.com/acme/app/pull/4", User: githubUser{Login: "alice"}, MergedAt: &merged}
+	pr.Base.Ref = "master"
+	reviews := []githubReview{{Id: 40, User: githubUser{Login: "bob"}, State: "APPROVED", SubmittedAt: merged.Add(-time.Hour)}}
+	comments := []githubComment{
+		{Id: 1, User: githubUser{Login: "bob"}, CreatedAt: merged.Add(-2 * time.Hour)},
+		{Id: 2, User: githubUser{Login: "bob"}, CreatedAt: merged.Add(time.Hour)},
+	}
+	cfg := Configuration{ReviewMinComments: 2, GithubUsers: []GithubUserInfo{
+		{Username: "alice", Email: "alice@acme.com"},
+		{Username: "bob", Email: "bob@acme.com"},
+	}}
+	grants := cfg.planBackfill("acme/app", pr, reviews, comments, func(a, b string) bool { return false })
+	if len(grants) != 2 {
+		t.Fatalf("Got %d grants, want 2: %#v", len(grants), grants)
+	}
+	if want := "only 1 of 2 review comments"; grants[1].Skipped != want {
+		t.Errorf("bob's review: got skipped %q, want %q", grants[1].Skipped, want)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	netmail "net/mail"
 	"strconv"
@@ -17,21 +16,41 @@ import (
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/mail"
-	"google.golang.org/appengine/urlfetch"
 	"google.golang.org/appengine/user"
 
 	"github.com/go-martini/martini"
+
+	"github.com/augustoroman/chompy/snackbot"
 )
 
 var (
 	showRewardTpl        = template.Must(template.ParseFiles("templates/show_reward.html"))
 	usedRewardTpl        = template.Must(template.ParseFiles("templates/used_reward.html"))
+	rewardHistoryTpl     = template.Must(template.ParseFiles("templates/reward_history.html"))
 	homeHtmlTpl          = template.Must(template.ParseFiles("templates/home.html"))
 	emailTextTpl         = template.Must(template.ParseFiles("templates/email.txt"))
 	emailHtmlTpl         = template.Must(template.ParseFiles("templates/email.html"))
 	donationEmailTextTpl = template.Must(template.ParseFiles("templates/donation_email.txt"))
 	donationEmailHtmlTpl = template.Must(template.ParseFiles("templates/donation_email.html"))
 	configHtmlTpl        = template.Must(template.ParseFiles("templates/config.html"))
+	teamsHtmlTpl         = template.Must(template.ParseFiles("templates/teams.html"))
+	teamEmailTextTpl     = template.Must(template.ParseFiles("templates/team_email.txt"))
+	teamEmailHtmlTpl     = template.Must(template.ParseFiles("templates/team_email.html"))
+	creditRequestHtmlTpl = template.Must(template.ParseFiles("templates/credit_request.html"))
+	statsHtmlTpl         = template.Must(template.ParseFiles("templates/stats.html"))
+	dispensersHtmlTpl    = template.Must(template.ParseFiles("templates/dispensers.html"))
+	uptimeHtmlTpl        = template.Must(template.ParseFiles("templates/uptime.html"))
+
+	creditRequestEmailTextTpl = template.Must(template.ParseFiles("templates/credit_request_email.txt"))
+	creditRequestEmailHtmlTpl = template.Must(template.ParseFiles("templates/credit_request_email.html"))
+	queueEmailTextTpl         = template.Must(template.ParseFiles("templates/queue_email.txt"))
+	kioskHtmlTpl              = template.Must(template.ParseFiles("templates/kiosk.html"))
+	kioskCredentialHtmlTpl    = template.Must(template.ParseFiles("templates/kiosk_credential.html"))
+	penaltiesHtmlTpl          = template.Must(template.ParseFiles("templates/penalties.html"))
+	deliveriesHtmlTpl         = template.Must(template.ParseFiles("templates/deliveries.html"))
+	deliveryHtmlTpl           = template.Must(template.ParseFiles("templates/delivery.html"))
+	backfillHtmlTpl           = template.Must(template.ParseFiles("templates/backfill.html"))
+	backfillJobHtmlTpl        = template.Must(template.ParseFiles("templates/backfill_job.html"))
 )
 
 const home = "/me"
@@ -47,20 +66,98 @@ func init() {
 	m.Get("/config", Configure)
 	m.Post("/config", Configure)
 	m.Post("/dispense", Dispense)
-
-	m.Post("/webhook", HandleWebhook)
+	m.Get("/dispensers", ShowDispensers)
+	m.Post("/dispensers/:name/refill", RefillDispenser)
+	m.Post("/telemetry", HandleTelemetry)
+	m.Get("/uptime", ShowUptime)
+	m.Get("/admin/poll-status", PollStatus)
+	m.Get("/admin/expire-deliveries", ExpireDeliveries)
+	m.Post("/queue/:id/confirm", ConfirmQueuedDispense)
+	m.Post("/queue/:id/cancel", CancelQueuedDispense)
+	m.Get("/kiosk/:name", ShowKiosk)
+	m.Post("/kiosk/:name/login", KioskLogin)
+	m.Post("/kiosk/:name/dispense", KioskDispense)
+	m.Post("/me/kiosk", SetKioskCredential)
+	m.Post("/slack", HandleSlackCommand)
+	m.Post("/kudos", GiveKudos)
+	m.Post("/ci/jenkins", logDeliveries("jenkins"))
+	m.Post("/ci/build", logDeliveries("build"))
+	m.Get("/penalties", ShowPenalties)
+	m.Post("/penalties/:id/forgive", ForgivePenalty)
+	m.Get("/teams", ManageTeams)
+	m.Post("/teams", ManageTeams)
+	m.Post("/teams/:name/dispense", DispenseTeamReward)
+
+	m.Post("/webhook", logDeliveries("webhook"))
+	m.Get("/backfill", ShowBackfills)
+	m.Post("/backfill", StartBackfill)
+	m.Get("/backfill/:id", ShowBackfill)
+	m.Post("/backfill/:id/grant", GrantBackfill)
+	m.Get("/deliveries", ShowDeliveries)
+	m.Get("/deliveries/:id", ShowDelivery)
+	m.Post("/deliveries/:id/replay", ReplayDelivery)
 
 	m.Put("/r", AddReward)
 	m.Get("/r/:id", ShowReward)
 	m.Post("/r/:id", DispenseReward)
+	m.Get("/r/:id/history", ShowRewardHistory)
+	m.Post("/r/:id/revoke", RevokeReward)
+	m.Post("/admin/migrate-history", MigrateRewardHistory)
 	m.Post("/donate", DonateRewards)
+	m.Post("/ask", AskForCredits)
+	m.Get("/ask/:id", ShowCreditRequest)
+	m.Post("/ask/:id", ResolveCreditRequest)
+	m.Get("/stats", ShowStats)
+	m.Get("/stats.json", ShowStatsJson)
+	m.Post("/admin/rebuild-stats", RebuildStats)
 	m.Get(home, ShowHome)
+	m.Get("/metrics", ServeMetrics)
 	http.Handle("/", m)
 }
 
-func grantReward(c context.Context, r *http.Request, email, typ, desc string) (code int, err error) {
+// grantRewards grants n credits for the same thing.  Those after the first
+// are described as e.g. "desc (2 of 3)" so that each is a distinct reward.
+// Credits that were already granted are skipped, so that a redelivery grants
+// whatever an earlier, failed attempt didn't; it's only a conflict if they all
+// were.
+func grantRewards(c context.Context, r *http.Request, email, typ, desc string, n int) (code int, err error) {
+	granted := false
+	for i := 1; i == 1 || i <= n; i++ {
+		d := desc
+		if i > 1 {
+			d = fmt.Sprintf("%s (%d of %d)", desc, i, n)
+		}
+		code, err = grantReward(c, r, email, typ, d)
+		if err == nil {
+			granted = true
+		} else if code != http.StatusConflict {
+			return code, err
+		}
+	}
+	if granted {
+		return http.StatusOK, nil
+	}
+	return code, err
+}
+
+// cleanEmail accepts "Name (addr)" for "Name <addr>", which is awkward to
+// pass around in urls and shell scripts.
+func cleanEmail(email string) string {
 	email = strings.Replace(email, "(", "<", -1)
-	email = strings.Replace(email, ")", ">", -1)
+	return strings.Replace(email, ")", ">", -1)
+}
+
+// canonicalEmail returns the lowercased address in email, which may be in
+// the "Name (addr)" form, for storing and querying by.
+func canonicalEmail(email string) string {
+	if addr, err := netmail.ParseAddress(cleanEmail(email)); err == nil {
+		email = addr.Address
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func grantReward(c context.Context, r *http.Request, email, typ, desc string) (code int, err error) {
+	email = cleanEmail(email)
 
 	addr, _ := netmail.ParseAddress(email)
 
@@ -71,10 +168,9 @@ func grantReward(c context.Context, r *http.Request, email, typ, desc string) (c
 		EmailAddress: addr.Address,
 		Type:         typ,
 		Description:  desc,
-
-		Granted: time.Now(),
 		// Dispensed is left empty
 	}
+	reward.Grant()
 
 	log.Infof(c, "Granting reward to %s for %s: %s", email, typ, desc)
 
@@ -86,10 +182,28 @@ func grantReward(c context.Context, r *http.Request, email, typ, desc string) (c
 		return http.StatusConflict, fmt.Errorf("Reward already issued")
 	}
 
+	// Rewards go to paying off outstanding penalties first.
+	if paid, err := payPenalty(c, &reward); err != nil {
+		log.Errorf(c, "Failed to pay penalties of %q with %v: %v", reward.EmailAddress, key, err)
+		return http.StatusInternalServerError, fmt.Errorf("Failed to save reward")
+	} else if paid {
+		countStat(c, statEarned, reward.EmailAddress, reward.Type, 1)
+		metricGrants.WithLabelValues(reward.Type, grantSource(r)).Inc()
+		noteReward(c, uid)
+		log.Infof(c, "Reward %v paid off a penalty of %q", key, reward.EmailAddress)
+		if err := sendPenaltyPaidEmail(c, r, reward); err != nil {
+			log.Errorf(c, "Couldn't send penalty email for reward %v: %v", key, err)
+		}
+		return http.StatusOK, nil
+	}
+
 	if _, err := datastore.Put(c, key, &reward); err != nil {
 		log.Errorf(c, "Failed to save reward %v: %v\nReward:%#v", key, err, reward)
 		return http.StatusInternalServerError, fmt.Errorf("Failed to save reward")
 	}
+	noteReward(c, uid)
+	countStat(c, statEarned, reward.EmailAddress, reward.Type, 1)
+	metricGrants.WithLabelValues(reward.Type, grantSource(r)).Inc()
 
 	retrievalUrl := fmt.Sprintf("http://%s/r/%s", r.Host, uid)
 
@@ -132,14 +246,21 @@ func AddReward(w http.ResponseWriter, r *http.Request, c context.Context) {
 		return
 	}
 	email, typ, desc := r.FormValue("email"), r.FormValue("type"), r.FormValue("desc")
-	if email == "" || typ == "" || desc == "" {
+	team := r.FormValue("team")
+	if (email == "" && team == "") || typ == "" || desc == "" {
 		log.Errorf(c, "Malformatted request, from values: %v", r.Form)
 		http.Error(w,
-			fmt.Sprintf("Missing field: email:%q type:%q desc:%q", email, typ, desc),
+			fmt.Sprintf("Missing field: email:%q team:%q type:%q desc:%q", email, team, typ, desc),
 			http.StatusBadRequest)
 		return
 	}
 
+	if team != "" {
+		if code, err := grantTeamReward(c, r, team, typ, desc); err != nil {
+			http.Error(w, err.Error(), code)
+		}
+		return
+	}
 	if code, err := grantReward(c, r, email, typ, desc); err != nil {
 		http.Error(w, err.Error(), code)
 		return
@@ -170,7 +291,7 @@ func ShowReward(w http.ResponseWriter, r *http.Request, c context.Context, p mar
 		}
 		return
 	}
-	if err := showRewardTpl.Execute(w, nil); err != nil {
+	if err := showRewardTpl.Execute(w, GetChompyStatus(c)); err != nil {
 		log.Criticalf(c, "Failed to render show template: %v", err)
 	}
 }
@@ -184,39 +305,168 @@ func DispenseReward(w http.ResponseWriter, r *http.Request, c context.Context, p
 
 	reward, err := loadReward(c, Uid(p["id"]))
 	if err == datastore.ErrNoSuchEntity {
+		countDispense("not_found")
 		http.Error(w, "No such reward", http.StatusNotFound)
 		return
 	} else if err != nil {
+		countDispense("internal_error")
 		log.Criticalf(c, "Failed to read %s: %v", p["id"], err)
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
 	if !reward.Available() {
+		countDispense("unavailable")
 		log.Errorf(c, "Reward %s cannot be dispensed: %#v", p["id"], reward)
 		http.Error(w, "Not available", http.StatusGone)
 		return
 	}
-	client := urlfetch.Client(c)
-	resp, err := client.Post(cfg.DispenseUrl(), "", nil)
+	if reward.Team != "" {
+		countDispense("team_credit")
+		log.Errorf(c, "Reward %s belongs to team %q", p["id"], reward.Team)
+		http.Error(w, "Team credits must be dispensed from the team pool", http.StatusBadRequest)
+		return
+	}
+	d, err := cfg.Dispenser(r.FormValue("dispenser"))
 	if err != nil {
-		log.Criticalf(c, "Could not contact snackbot: %v", err)
-		http.Error(w, "Cannot contact snackbot, please try again later.", http.StatusServiceUnavailable)
+		countDispense("no_dispenser")
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		respContent, _ := ioutil.ReadAll(resp.Body)
-		log.Criticalf(c, "Could not contact snackbot: %s", respContent)
-		http.Error(w, "Cannot contact snackbot, please try again later.", http.StatusServiceUnavailable)
+	dispenser := reward.EmailAddress
+	if u := user.Current(c); u != nil {
+		dispenser = u.Email
+	}
+	// If asked, wait for an offline dispenser to come back rather than fail.
+	if r.FormValue("queue") != "" {
+		if status, err := d.Snackbot().Status(c); err != nil || !status.Online {
+			if _, err := queueDispense(c, reward, d, dispenser); err == errNotAvailable {
+				countDispense("unavailable")
+				http.Error(w, "Not available", http.StatusGone)
+				return
+			} else if err != nil {
+				countDispense("internal_error")
+				log.Criticalf(c, "Failed to queue %s for %q: %v", p["id"], d.Name, err)
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			countDispense("queued")
+			log.Infof(c, "%q queued reward %s until %q is back online", dispenser, p["id"], d.Name)
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "%s is offline.  We'll email you when it's back.", d.Name)
+			return
+		}
+	}
+	if !checkPresence(w, r, d) {
 		return
 	}
-	reward.Dispensed = time.Now()
-	if _, err := datastore.Put(c, reward.Uid().Key(c), &reward); err != nil {
-		log.Criticalf(c, "Cannot update reward %s: %v\n%s", reward.Uid(), err, reward)
+	if code, err := dispenseReward(c, reward.Uid().Key(c), d, dispenser); err != nil {
+		http.Error(w, err.Error(), code)
+		return
 	}
 	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 }
 
+// dispenseReward uses a reward to dispense candy.  The reward is marked as
+// dispensed before asking the dispenser so that it can't be used twice, and
+// refunded unless the device confirms that the candy came out.
+func dispenseReward(c context.Context, key *datastore.Key, d Dispenser, actor string) (code int, err error) {
+	if d.AgentSecret == "" {
+		// The agent would reject the unsigned request anyway.
+		countDispense("no_secret")
+		log.Criticalf(c, "Dispenser %q has no agent secret, set one on /config", d.Name)
+		return http.StatusServiceUnavailable,
+			fmt.Errorf("%s isn't set up yet: an admin needs to give it an agent secret", d.Name)
+	}
+	var reward Reward
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, key, &reward); err != nil {
+			return err
+		}
+		if !reward.Available() {
+			return errNotAvailable
+		}
+		reward.Dispense(actor)
+		_, err := datastore.Put(c, key, &reward)
+		return err
+	}, nil)
+	if err == errNotAvailable {
+		countDispense("unavailable")
+		return http.StatusGone, fmt.Errorf("Not available")
+	} else if err != nil {
+		countDispense("internal_error")
+		log.Criticalf(c, "Cannot reserve reward %v: %v", key, err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal error")
+	}
+
+	if err := dispenseCandy(c, d); err != nil {
+		refundReward(c, key, fmt.Sprintf("Dispense from %s failed: %v", d.Name, err))
+		msg, code := snackbotError(err)
+		return code, fmt.Errorf("%s", msg)
+	}
+	countDispense("")
+	countStat(c, statDispensed, actor, reward.Type, 1)
+	log.Infof(c, "%q dispensed reward %v from %q", actor, key, d.Name)
+	return http.StatusOK, nil
+}
+
+func refundReward(c context.Context, key *datastore.Key, msg string) {
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var reward Reward
+		if err := datastore.Get(c, key, &reward); err != nil {
+			return err
+		}
+		reward.Refund(msg)
+		_, err := datastore.Put(c, key, &reward)
+		return err
+	}, nil)
+	if err != nil {
+		log.Criticalf(c, "Cannot refund reward %v (%s): %v", key, msg, err)
+		return
+	}
+	log.Warningf(c, "Refunded reward %v: %s", key, msg)
+}
+
+// dispenseCandy asks a dispenser to dispense a single reward's worth of candy
+// and waits for the device to confirm that it did.
+func dispenseCandy(c context.Context, d Dispenser) error {
+	bot := d.Snackbot()
+	id, err := bot.Dispense(c, d.DispenseTime)
+	if err == nil {
+		err = bot.WaitForDispense(c, id, d.DispenseTime+confirmTimeout)
+	}
+	if err != nil {
+		log.Criticalf(c, "Could not dispense from %q: %v", d.Name, err)
+		countDispense(agentErrorReason(err))
+	}
+	return err
+}
+
+// How long to wait, beyond the dispense time itself, for the device to
+// confirm a dispense.
+const confirmTimeout = 10 * time.Second
+
+// snackbotError returns the message and status code to show users for a
+// failed request to the snackbot.
+func snackbotError(err error) (string, int) {
+	switch {
+	case snackbot.IsOffline(err):
+		return "Chompy is offline, please try again later.", http.StatusServiceUnavailable
+	case snackbot.IsTimeout(err):
+		return "Chompy didn't confirm the dispense in time.  Your credit has been refunded.",
+			http.StatusGatewayTimeout
+	case snackbot.IsNotDispensed(err):
+		return "Chompy couldn't dispense.  Your credit has been refunded.", http.StatusBadGateway
+	}
+	return "Chompy refused to dispense, please try again later.", http.StatusBadGateway
+}
+
+func agentErrorReason(err error) string {
+	if e, ok := err.(*snackbot.Error); ok {
+		return "agent_" + e.Kind.String()
+	}
+	return "agent_error"
+}
+
 func DonateRewards(w http.ResponseWriter, r *http.Request, c context.Context) {
 	u := user.Current(c)
 	if u == nil {
@@ -229,95 +479,209 @@ func DonateRewards(w http.ResponseWriter, r *http.Request, c context.Context) {
 		u.Email = r.FormValue("user")
 	}
 
-	rawemail, numstr, msg := r.FormValue("email"), r.FormValue("num"), r.FormValue("msg")
-	rawemail = strings.Replace(rawemail, "(", "<", -1)
-	rawemail = strings.Replace(rawemail, ")", ">", -1)
-	addr, err2 := netmail.ParseAddress(rawemail)
+	numstr, msg := r.FormValue("num"), r.FormValue("msg")
+	recipients, err2 := parseEmailList(r.FormValue("email"))
+	for _, email := range recipients {
+		if strings.EqualFold(email, u.Email) {
+			log.Warningf(c, "%q may be a narcissist: n=%s", u.Email, numstr)
+			http.Error(w, "Donating to yourself?  Really?", http.StatusBadRequest)
+			return
+		}
+	}
+	if teamName := r.FormValue("team"); teamName != "" && err2 == nil {
+		team, err := loadTeam(c, teamName)
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, fmt.Sprintf("No such team: %q", teamName), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Criticalf(c, "Failed to load team %q: %v", teamName, err)
+			http.Error(w, "Internal error, no rewards have been donated",
+				http.StatusInternalServerError)
+			return
+		}
+		for _, email := range team.Members {
+			// Donating to your own team is fine, just not to yourself.
+			if !strings.EqualFold(email, u.Email) {
+				recipients = append(recipients, email)
+			}
+		}
+	}
+	recipients = uniqueStrings(recipients)
+
+	// Either specific rewards are donated by id, or the oldest num rewards.
+	var ids []Uid
+	for _, id := range r.Form["id"] {
+		ids = append(ids, Uid(id))
+	}
 	num, err := strconv.Atoi(numstr)
-	if err2 != nil || err != nil || num == 0 || addr == nil {
-		log.Errorf(c, "Bad inputs: email=%q numstr=%q err=%v err2=%v", rawemail, numstr, err, err2)
+	if len(ids) > 0 && numstr == "" {
+		num, err = len(ids), nil
+	}
+	if err2 != nil || err != nil || num <= 0 || len(recipients) == 0 {
+		log.Errorf(c, "Bad inputs: email=%q team=%q numstr=%q err=%v err2=%v",
+			r.FormValue("email"), r.FormValue("team"), numstr, err, err2)
 		http.Error(w, "Bad inputs", http.StatusBadRequest)
 		return
 	}
-	email := addr.Address
 
-	if email == u.Email {
-		log.Warningf(c, "%q may be a narcissist: n=%d", u.Email, num)
-		http.Error(w, "Donating to yourself?  Really?", http.StatusBadRequest)
+	donated, code, err := donateRewards(c, u.Email, recipients, msg, ids, num)
+	if err != nil {
+		http.Error(w, err.Error(), code)
 		return
 	}
 
-	var rewards []Reward
-	keys, err := datastore.NewQuery("rewards").
-		Filter("EmailAddress =", u.Email).
-		Order("-Granted").
-		GetAll(c, &rewards)
-	if err != nil {
-		log.Criticalf(c, "Failed to load rewards for %v", u)
-		http.Error(w, "Internal error, no rewards have been donated",
+	// Send one combined notification to each recipient.
+	perRecipient := map[string]int{}
+	for _, reward := range donated {
+		perRecipient[reward.EmailAddress]++
+	}
+	var failed []string
+	for _, email := range recipients {
+		if perRecipient[email] == 0 {
+			continue
+		}
+		if err := sendDonationEmail(c, r, u.Email, email, msg, perRecipient[email]); err != nil {
+			log.Errorf(c, "Couldn't send email for donation to %q: %v", email, err)
+			failed = append(failed, email)
+		}
+	}
+	if len(failed) > 0 {
+		http.Error(w, "Donations sent, but notification email failed.  "+
+			"Tell them about the credits: "+strings.Join(failed, ", "),
 			http.StatusInternalServerError)
 		return
 	}
 
-	available := 0
-	for _, r := range rewards {
-		if r.Available() {
-			available++
-		}
+	donatedIds := []Uid{}
+	for _, reward := range donated {
+		donatedIds = append(donatedIds, reward.Uid())
 	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"donated":    len(donated),
+		"ids":        donatedIds,
+		"to":         strings.Join(recipients, ", "),
+		"recipients": perRecipient,
+	})
+}
+
+// The most entity groups, here rewards, a cross-group transaction may use.
+const maxXGEntities = 25
 
-	if num > available {
-		num = available
+// donateRewards moves rewards from one user to others, handing them out
+// round-robin among the recipients.  If ids is given, exactly those rewards
+// are donated and all of them must be available and belong to the donor.
+// Otherwise the donor's num oldest available rewards are donated.  Nothing is
+// donated unless the whole donation can be made, though donations of more
+// than maxXGEntities rewards can fail partway.
+func donateRewards(c context.Context, from string, to []string, msg string, ids []Uid, num int) (donated []Reward, code int, err error) {
+	var rewards []Reward
+	keys, err := datastore.NewQuery("rewards").
+		Filter("EmailAddress =", from).
+		Order("-Granted").
+		GetAll(c, &rewards)
+	if err != nil {
+		log.Criticalf(c, "Failed to load rewards for %q: %v", from, err)
+		return nil, http.StatusInternalServerError,
+			fmt.Errorf("Internal error, no rewards have been donated")
 	}
 
 	var donatedKeys []*datastore.Key
-	var donatedRewards []Reward
-	for i := len(rewards) - 1; i >= 0 && len(donatedRewards) < num; i-- {
-		reward, key := &rewards[i], keys[i]
-		if !reward.Available() {
-			continue
+	if len(ids) > 0 {
+		byId := map[Uid]int{}
+		for i := range rewards {
+			byId[rewards[i].Uid()] = i
+		}
+		for _, id := range ids {
+			i, ok := byId[id]
+			if !ok || !rewards[i].Available() {
+				log.Errorf(c, "%q cannot donate reward %s", from, id)
+				return nil, http.StatusBadRequest,
+					fmt.Errorf("Reward %s is not available to donate, no rewards have been donated", id)
+			}
+			delete(byId, id) // don't donate the same reward twice
+			donatedKeys = append(donatedKeys, keys[i])
+			donated = append(donated, rewards[i])
+		}
+	} else {
+		for i := len(rewards) - 1; i >= 0 && len(donated) < num; i-- {
+			if !rewards[i].Available() {
+				continue
+			}
+			donatedKeys = append(donatedKeys, keys[i])
+			donated = append(donated, rewards[i])
+		}
+		if len(donated) < num {
+			log.Errorf(c, "%q tried to donate %d credits but only has %d", from, num, len(donated))
+			return nil, http.StatusBadRequest,
+				fmt.Errorf("You only have %d credits, no rewards have been donated", len(donated))
+		}
+	}
+	// The rewards were read outside of a transaction, so check again inside
+	// one that they're still available and the donor's: they may have been
+	// dispensed or donated meanwhile.
+	for start := 0; start < len(donatedKeys); start += maxXGEntities {
+		end := start + maxXGEntities
+		if end > len(donatedKeys) {
+			end = len(donatedKeys)
+		}
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			batch := make([]Reward, end-start)
+			if err := datastore.GetMulti(c, donatedKeys[start:end], batch); err != nil {
+				return err
+			}
+			for i := range batch {
+				if !batch[i].Available() || batch[i].EmailAddress != from {
+					return errNotAvailable
+				}
+				batch[i].DonateTo(to[(start+i)%len(to)], msg)
+			}
+			if _, err := datastore.PutMulti(c, donatedKeys[start:end], batch); err != nil {
+				return err
+			}
+			copy(donated[start:end], batch)
+			return nil
+		}, &datastore.TransactionOptions{XG: true})
+		if err == errNotAvailable && start == 0 {
+			log.Errorf(c, "Rewards of %q were used while donating them", from)
+			return nil, http.StatusConflict,
+				fmt.Errorf("Some of your credits were used meanwhile, no rewards have been donated")
+		} else if err != nil {
+			log.Criticalf(c, "Failed to save donations: %v", err)
+			return nil, http.StatusInternalServerError,
+				fmt.Errorf("Internal error: some rewards may have been donated.  Sorry.")
 		}
-		reward.DonateTo(email, msg)
-		donatedKeys = append(donatedKeys, key)
-		donatedRewards = append(donatedRewards, *reward)
 	}
 
 	log.Infof(c, "%q donated %d credits to %q  -- Msg: %q",
-		u.Email, len(donatedKeys), email, msg)
+		from, len(donatedKeys), to, msg)
 
-	_, err = datastore.PutMulti(c, donatedKeys, donatedRewards)
-	if err != nil {
-		log.Criticalf(c, "Failed to save donations: %v", err)
-		http.Error(w, "Internal error: some rewards may have been donated.  Sorry.",
-			http.StatusInternalServerError)
-		return
+	metricDonations.Add(float64(len(donated)))
+	byType := map[string]int{}
+	for _, reward := range donated {
+		byType[reward.Type]++
 	}
+	for typ, n := range byType {
+		countStat(c, statDonated, from, typ, n)
+	}
+	return donated, http.StatusOK, nil
+}
 
+func sendDonationEmail(c context.Context, r *http.Request, from, to, msg string, n int) error {
 	data := map[string]interface{}{
 		"message":  msg,
-		"from":     u.Email,
-		"N":        len(donatedRewards),
+		"from":     from,
+		"N":        n,
 		"home_url": fmt.Sprintf("http://%s/me", r.Host),
 	}
 	emailMessage := &mail.Message{
 		Sender:   fmt.Sprintf("Chompy <notify@%s.appspotmail.com>", appengine.AppID(c)),
-		To:       []string{email},
+		To:       []string{to},
 		Subject:  "You've got candy!",
 		Body:     renderTemplateOrDie(donationEmailTextTpl, data),
 		HTMLBody: renderTemplateOrDie(donationEmailHtmlTpl, data),
 	}
-	if err := mail.Send(c, emailMessage); err != nil {
-		log.Errorf(c, "Couldn't send email for donation: %v", err)
-		http.Error(w, "Donations sent, but notification email failed.  "+
-			"Tell them about the credits", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"donated": len(donatedRewards),
-		"to":      email,
-	})
+	return mail.Send(c, emailMessage)
 }
 
 func ShowHome(w http.ResponseWriter, r *http.Request, c context.Context) {
@@ -350,19 +714,73 @@ func ShowHome(w http.ResponseWriter, r *http.Request, c context.Context) {
 		}
 	}
 
+	teams, err := loadTeams(c)
+	if err != nil {
+		log.Criticalf(c, "Failed to load teams: %v", err)
+	}
+
+	balances, err := teamBalances(c, u.Email)
+	if err != nil {
+		log.Criticalf(c, "Failed to load team balances for %v: %v", u, err)
+	}
+
+	incoming, outgoing, err := creditRequestsFor(c, u)
+	if err != nil {
+		log.Criticalf(c, "Failed to load credit requests for %v: %v", u, err)
+	}
+
+	queued, err := pendingDispensesFor(c, u.Email)
+	if err != nil {
+		log.Criticalf(c, "Failed to load queued dispenses for %v: %v", u, err)
+	}
+
+	penalties, err := outstandingPenalties(c, u.Email)
+	if err != nil {
+		log.Criticalf(c, "Failed to load penalties for %v: %v", u, err)
+	}
+
+	kudos := 0
+	if cfg, err := getConfig(c); err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+	} else if cfg.CanMintKudos(u.Email) {
+		kudos = -1 // unlimited
+	} else if kudos, err = kudosRemaining(c, cfg, u.Email); err != nil {
+		log.Criticalf(c, "Failed to load kudos allowance for %v: %v", u, err)
+	}
+
 	params := struct {
-		User           *user.User
-		LogoutUrl      string
-		Rewards        []Reward
-		TotalCount     int
-		AvailableCount int
-		Status         Status
-	}{u, logoutUrl, rewards, len(rewards), numAvailable, GetChompyStatus(c)}
+		User             *user.User
+		LogoutUrl        string
+		Rewards          []Reward
+		TotalCount       int
+		AvailableCount   int
+		Status           Status
+		Teams            []Team
+		TeamBalances     []TeamBalance
+		IncomingRequests []PendingCreditRequest
+		OutgoingRequests []PendingCreditRequest
+		QueuedDispenses  []PendingDispense
+		KudosRemaining   int
+		Penalties        []PenaltyEntry
+	}{u, logoutUrl, rewards, len(rewards), numAvailable, GetChompyStatus(c), teams, balances,
+		incoming, outgoing, queued, kudos, penalties}
 	if err := homeHtmlTpl.Execute(w, params); err != nil {
 		log.Criticalf(c, "Failed to render home template: %v", err)
 	}
 }
 
+func uniqueStrings(list []string) []string {
+	var unique []string
+	seen := map[string]bool{}
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
 func must(data []byte, err error) string {
 	if err != nil {
 		panic(err)
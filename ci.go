@@ -0,0 +1,353 @@
+package chompy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// BuildEvent is a finished CI build from any of the supported CI systems.
+type BuildEvent struct {
+	Source  string // "github-actions", "jenkins" or "build"
+	Project string // e.g. "org/repo/workflow" or the Jenkins job
+	Branch  string
+	Url     string // unique for each build
+	Success bool
+
+	// Whoever's change was built.  Login is a github username, used when
+	// the email address isn't known.
+	Email string
+	Login string
+}
+
+// BuildState is the last known result of a project's branch, so that we can
+// tell when a build is fixed or broken.
+type BuildState struct {
+	Project  string
+	Branch   string
+	Success  bool
+	Url      string
+	Updated  time.Time
+	BrokenBy string // who broke it, if it's broken
+
+	// The build that last fixed or broke the branch, and which it did, so
+	// that a replay of its webhook does the same again, e.g. grants the
+	// build-fixed credit that was missed because its author wasn't known.
+	TransitionUrl string
+	Transition    string
+}
+
+// What a build did to its branch.
+const (
+	BuildFixed = "fixed"
+	BuildBroke = "broke"
+)
+
+func buildStateKey(c context.Context, project, branch string) *datastore.Key {
+	return datastore.NewKey(c, "build_states", project+"|"+branch, 0, nil)
+}
+
+// buildTransition returns whether the build at url fixed or broke its
+// branch, given the previous state if there is one.
+func buildTransition(prev *BuildState, url string, success bool) string {
+	switch {
+	case prev == nil:
+		return "" // We don't know what it was before.
+	case url != "" && url == prev.TransitionUrl:
+		return prev.Transition // Seen before, e.g. replayed.
+	case !prev.Success && success:
+		return BuildFixed
+	case prev.Success && !success:
+		return BuildBroke
+	}
+	return ""
+}
+
+// isBuildBranch returns whether builds of branch count for fixing or breaking
+// the build.  defaultBranch is the repository's default branch, if known.
+func (cfg Configuration) isBuildBranch(branch, defaultBranch string) bool {
+	if len(cfg.BuildBranches) > 0 {
+		for _, b := range cfg.BuildBranches {
+			if b == branch {
+				return true
+			}
+		}
+		return false
+	}
+	if defaultBranch != "" {
+		return branch == defaultBranch
+	}
+	return branch == "main" || branch == "master"
+}
+
+func (cfg Configuration) buildEmail(ev BuildEvent) string {
+	if ev.Email != "" {
+		return ev.Email
+	}
+	for _, u := range cfg.GithubUsers {
+		if ev.Login != "" && strings.EqualFold(u.Username, ev.Login) {
+			return u.Email
+		}
+	}
+	return ""
+}
+
+// processBuildEvent records a build's result and credits whoever fixed a
+// broken build with the given number of credits.
+func processBuildEvent(c context.Context, r *http.Request, cfg Configuration, ev BuildEvent, credits int) (code int, err error) {
+	email := cfg.buildEmail(ev)
+	key := buildStateKey(c, ev.Project, ev.Branch)
+	var transition string
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var prev *BuildState
+		state := BuildState{Project: ev.Project, Branch: ev.Branch}
+		if err := datastore.Get(c, key, &state); err == nil {
+			prev = &BuildState{}
+			*prev = state
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		transition = buildTransition(prev, ev.Url, ev.Success)
+		switch transition {
+		case BuildBroke:
+			state.BrokenBy = email
+		case BuildFixed:
+			state.BrokenBy = ""
+		}
+		if transition != "" {
+			state.TransitionUrl, state.Transition = ev.Url, transition
+		}
+		state.Success, state.Url, state.Updated = ev.Success, ev.Url, time.Now()
+		_, err := datastore.Put(c, key, &state)
+		return err
+	}, nil)
+	if err != nil {
+		log.Criticalf(c, "Failed to record build %s: %v", ev.Url, err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal error")
+	}
+	log.Infof(c, "Build %s of %s@%s: success=%v transition=%q by %q",
+		ev.Url, ev.Project, ev.Branch, ev.Success, transition, email)
+
+	switch transition {
+	case BuildFixed:
+		if email == "" {
+			log.Errorf(c, "Don't know who fixed %s (%q)", ev.Url, ev.Login)
+			return http.StatusNoContent, nil
+		}
+		return grantRewards(c, r, email, "build-fixed", ev.Url, credits)
+	case BuildBroke:
+		log.Warningf(c, "%q broke %s@%s: %s", email, ev.Project, ev.Branch, ev.Url)
+		if email != "" {
+			if err := addPenalty(c, cfg, email, PenaltyBuildBroke, ev.Url); err != nil {
+				log.Criticalf(c, "Failed to penalize %q for %s: %v", email, ev.Url, err)
+				return http.StatusInternalServerError, fmt.Errorf("Internal error")
+			}
+		}
+	}
+	return http.StatusNoContent, nil
+}
+
+func (g *GithubWebhookRequest) HandleWorkflowRun(body []byte) {
+	type EventData struct {
+		Action      string
+		WorkflowRun struct {
+			Name       string
+			HeadBranch string `json:"head_branch"`
+			Conclusion string
+			HtmlUrl    string `json:"html_url"`
+			Actor      struct{ Login string }
+			HeadCommit struct {
+				Author struct{ Email string }
+			} `json:"head_commit"`
+		} `json:"workflow_run"`
+		Repository struct {
+			FullName      string `json:"full_name"`
+			DefaultBranch string `json:"default_branch"`
+		}
+	}
+	var eventData EventData
+	if err := json.Unmarshal(body, &eventData); err != nil {
+		log.Criticalf(g.c, "Cannot parse json payload: %v", err)
+		http.Error(g.w, "Can't parse JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	run := eventData.WorkflowRun
+	log.Debugf(g.c, "Workflow run %q of %s@%s: %q %q", run.Name, eventData.Repository.FullName,
+		run.HeadBranch, eventData.Action, run.Conclusion)
+
+	// Cancelled and skipped runs say nothing about whether the build works.
+	buildBranch := g.Config.isBuildBranch(run.HeadBranch, eventData.Repository.DefaultBranch)
+	if len(g.Repo.branches()) > 0 {
+		buildBranch = g.Repo.branchAllowed(run.HeadBranch)
+	}
+	if eventData.Action != "completed" || (run.Conclusion != "success" && run.Conclusion != "failure") ||
+		!buildBranch || !g.Repo.rewards("build-fixed") {
+		g.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ev := BuildEvent{
+		Source:  "github-actions",
+		Project: eventData.Repository.FullName + "/" + run.Name,
+		Branch:  run.HeadBranch,
+		Url:     run.HtmlUrl,
+		Success: run.Conclusion == "success",
+		Login:   run.Actor.Login,
+	}
+	if g.LookGithubUser(run.Actor.Login) == nil {
+		ev.Email = run.HeadCommit.Author.Email
+	}
+	if code, err := processBuildEvent(g.c, g.r, g.Config, ev, g.Repo.credits()); err != nil {
+		http.Error(g.w, err.Error(), code)
+		return
+	}
+	g.w.WriteHeader(http.StatusNoContent)
+}
+
+// jenkinsBuildEvent converts a Jenkins notification plugin payload.  It
+// returns false for notifications that aren't a finished build.
+func jenkinsBuildEvent(body []byte) (BuildEvent, bool, error) {
+	var payload struct {
+		Name  string
+		Build struct {
+			FullUrl string `json:"full_url"`
+			Phase   string
+			Status  string
+			Scm     struct {
+				Branch   string
+				Culprits []string
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return BuildEvent{}, false, err
+	}
+	b := payload.Build
+	// Jenkins sends both COMPLETED and FINALIZED; only count the build once.
+	// Aborted or not-built results say nothing about the code.
+	if b.Phase != "COMPLETED" || (b.Status != "SUCCESS" && b.Status != "FAILURE" && b.Status != "UNSTABLE") {
+		return BuildEvent{}, false, nil
+	}
+	ev := BuildEvent{
+		Source:  "jenkins",
+		Project: payload.Name,
+		Branch:  strings.TrimPrefix(b.Scm.Branch, "origin/"),
+		Url:     b.FullUrl,
+		Success: b.Status == "SUCCESS",
+	}
+	// Culprits are Jenkins user ids, which are either email addresses or
+	// (often) the same as github usernames.
+	if len(b.Scm.Culprits) > 0 {
+		if culprit := b.Scm.Culprits[0]; strings.Contains(culprit, "@") {
+			ev.Email = culprit
+		} else {
+			ev.Login = culprit
+		}
+	}
+	return ev, true, nil
+}
+
+// HandleJenkins receives Jenkins notification plugin webhooks.  Jenkins can't
+// sign them, so the URL must include ?auth=<secret token>.
+func HandleJenkins(w http.ResponseWriter, r *http.Request, c context.Context) {
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() { metricWebhooks.WithLabelValues("jenkins", "", rec.Outcome()).Inc() }()
+
+	cfg, body, ok := readCIRequest(rec, r, c)
+	if !ok {
+		return
+	}
+	valid := cfg.validAuth(r.URL.Query().Get("auth"))
+	noteSignature(c, valid)
+	if !valid {
+		log.Errorf(c, "Bad auth code")
+		http.Error(rec, "Bad auth code", http.StatusUnauthorized)
+		return
+	}
+	ev, finished, err := jenkinsBuildEvent(body)
+	if err != nil {
+		log.Errorf(c, "Failed to decode Jenkins notification: %v", err)
+		http.Error(rec, "Bad payload", http.StatusBadRequest)
+		return
+	}
+	if !finished || !cfg.isBuildBranch(ev.Branch, "") {
+		rec.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if code, err := processBuildEvent(c, r, cfg, ev, 1); err != nil {
+		http.Error(rec, err.Error(), code)
+		return
+	}
+	rec.WriteHeader(http.StatusNoContent)
+}
+
+// HandleBuild receives build results from any other CI system, as JSON:
+//
+//	{"Auth": "<secret token>", "Project": "...", "Branch": "main",
+//	 "Url": "<build url>", "Success": true, "Email": "<author>"}
+func HandleBuild(w http.ResponseWriter, r *http.Request, c context.Context) {
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() { metricWebhooks.WithLabelValues("build", "", rec.Outcome()).Inc() }()
+
+	cfg, body, ok := readCIRequest(rec, r, c)
+	if !ok {
+		return
+	}
+	var payload struct {
+		Auth string
+		BuildEvent
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		log.Errorf(c, "Failed to decode json payload: %v", err)
+		http.Error(rec, "Bad payload", http.StatusBadRequest)
+		return
+	}
+	valid := cfg.validAuth(payload.Auth)
+	noteSignature(c, valid)
+	if !valid {
+		log.Errorf(c, "Bad auth code")
+		http.Error(rec, "Bad auth code", http.StatusUnauthorized)
+		return
+	}
+	ev := payload.BuildEvent
+	if ev.Project == "" || ev.Branch == "" || ev.Url == "" {
+		log.Errorf(c, "Missing required fields: %#v", ev)
+		http.Error(rec, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+	ev.Source = "build"
+	if !cfg.isBuildBranch(ev.Branch, "") {
+		rec.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if code, err := processBuildEvent(c, r, cfg, ev, 1); err != nil {
+		http.Error(rec, err.Error(), code)
+		return
+	}
+	rec.WriteHeader(http.StatusNoContent)
+}
+
+func readCIRequest(w http.ResponseWriter, r *http.Request, c context.Context) (Configuration, []byte, bool) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return cfg, nil, false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Criticalf(c, "Failed to read request body: %v", err)
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return cfg, nil, false
+	}
+	_, logged := withAuth("", body, redactedSecret)
+	log.Infof(c, "Got request body: %s", logged)
+	return cfg, body, true
+}
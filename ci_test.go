@@ -0,0 +1,79 @@
+package chompy
+
+import "testing"
+
+// As sent by the Jenkins notification plugin.
+const jenkinsPayload = `{"name":"chompy","display_name":"chompy","url":"job/chompy/","build":{"full_url":"http://ci.example.com/job/chompy/18/","number":18,"queue_id":1,"timestamp":1462060800000,"phase":"COMPLETED","status":"SUCCESS","url":"job/chompy/18/","scm":{"url":"https://github.com/augustoroman/chompy.git","branch":"origin/master","commit":"c6d86dc7c5e5f4a5a4f7a0fb3e2e9c0cb0ba6dd8","changes":["chompy.go"],"culprits":["augustoroman"]},"log":"","notes":"","artifacts":{}}}`
+
+func TestJenkinsBuildEvent(t *testing.T) {
+	ev, finished, err := jenkinsBuildEvent([]byte(jenkinsPayload))
+	if err != nil || !finished {
+		t.Fatalf("finished=%v err=%v", finished, err)
+	}
+	want := BuildEvent{
+		Source:  "jenkins",
+		Project: "chompy",
+		Branch:  "master",
+		Url:     "http://ci.example.com/job/chompy/18/",
+		Success: true,
+		Login:   "augustoroman",
+	}
+	if ev != want {
+		t.Errorf("Wrong event:\n got %#v\nwant %#v", ev, want)
+	}
+
+	started := `{"name":"chompy","build":{"full_url":"http://ci.example.com/job/chompy/19/","phase":"STARTED"}}`
+	if _, finished, err := jenkinsBuildEvent([]byte(started)); err != nil || finished {
+		t.Errorf("Started build: finished=%v err=%v", finished, err)
+	}
+}
+
+func TestBuildTransition(t *testing.T) {
+	green, red := &BuildState{Success: true}, &BuildState{Success: false}
+	fixed := &BuildState{Success: true, Url: "build/2", TransitionUrl: "build/2", Transition: BuildFixed}
+	broken := &BuildState{Success: false, Url: "build/3", TransitionUrl: "build/3", Transition: BuildBroke}
+	testCases := []struct {
+		prev    *BuildState
+		url     string
+		success bool
+		want    string
+	}{
+		{nil, "build/1", true, ""},
+		{nil, "build/1", false, ""},
+		{green, "build/1", true, ""},
+		{green, "build/1", false, BuildBroke},
+		{red, "build/1", false, ""},
+		{red, "build/1", true, BuildFixed},
+		// Replays of the build that fixed or broke the branch.
+		{fixed, "build/2", true, BuildFixed},
+		{fixed, "build/3", true, ""},
+		{broken, "build/3", false, BuildBroke},
+		{&BuildState{Success: true, Url: "build/4"}, "build/4", true, ""},
+	}
+	for _, tc := range testCases {
+		if got := buildTransition(tc.prev, tc.url, tc.success); got != tc.want {
+			t.Errorf("%+v -> %s success=%v: got %q, want %q", tc.prev, tc.url, tc.success, got, tc.want)
+		}
+	}
+}
+
+func TestIsBuildBranch(t *testing.T) {
+	var cfg Configuration
+	if !cfg.isBuildBranch("master", "") || !cfg.isBuildBranch("trunk", "trunk") || cfg.isBuildBranch("feature", "") {
+		t.Errorf("Default build branches are wrong")
+	}
+	cfg.BuildBranches = []string{"release"}
+	if !cfg.isBuildBranch("release", "main") || cfg.isBuildBranch("main", "main") {
+		t.Errorf("Configured build branches are ignored")
+	}
+}
+
+func TestValidAuth(t *testing.T) {
+	cfg := Configuration{SecretAuthToken: "hunter2"}
+	if !cfg.validAuth("hunter2") || cfg.validAuth("hunter") || cfg.validAuth("") {
+		t.Errorf("Wrong auth check against %q", cfg.SecretAuthToken)
+	}
+	if (Configuration{}).validAuth("") {
+		t.Errorf("Empty auth accepted without a secret token")
+	}
+}
@@ -1,24 +1,64 @@
 package chompy
 
 import (
+	"crypto/hmac"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 	"google.golang.org/appengine/user"
 )
 
 type Configuration struct {
-	AgentURL        string
+	Dispensers      []Dispenser
 	SecretAuthToken string
-	DispenseTime    time.Duration
 	GithubUsers     []GithubUserInfo
+	GithubRepos     []GithubRepo
+	// Token for reading pull requests from the GitHub API when backfilling.
+	GithubToken string
+
+	// Slack app used for /chompy commands.  The bot token needs the
+	// users:read.email scope to find out who's who.
+	SlackSigningSecret string
+	SlackBotToken      string
+	// Kudos everyone can give each month, and people who can give as many
+	// as they like.  Only people chompy knows get the monthly allowance: see
+	// kudosEligible, which also counts anyone in KudosDomains.
+	KudosAllowance int
+	KudosGivers    []string
+	KudosDomains   []string // e.g. "example.com"
+
+	// Branches whose CI builds count for fixing (or breaking) the build.
+	// Defaults to the repository's default branch, or main and master.
+	BuildBranches []string
+
+	// Rules for crediting pull request reviews: the minimum number of review
+	// comments, and the size in lines below which reviewing a pull request by
+	// a teammate doesn't count.  0 disables either rule.
+	ReviewMinComments  int
+	ReviewTrivialLines int
+
+	// Filters for github pull requests: accounts (besides bots) that never
+	// earn credits, whether merged pull requests need an approving review,
+	// and repos, base branches and labels whose pull requests don't count.
+	GithubIgnoredUsers     []string
+	GithubRequireApproval  bool
+	GithubExcludedRepos    []string
+	GithubExcludedBranches []string
+	GithubOptOutLabels     []string
+
+	// Kinds of penalties (see penalty.go) that are enabled.
+	Penalties []string
+
+	// Configuration of the single dispenser from before Dispensers existed.
+	// These are moved into Dispensers when the configuration is loaded.
+	AgentURL     string
+	DispenseTime time.Duration
 }
 
 // Allows sending candy to github users.
@@ -26,21 +66,26 @@ type GithubUserInfo struct {
 	Username, Email string
 }
 
-func (c *Configuration) StatusUrl() string {
-	return strings.TrimRight(c.AgentURL, "/") + "/status"
-}
-func (c *Configuration) DispenseUrl() string {
-	path := fmt.Sprintf("/dispense?amount=%f", c.DispenseTime.Seconds())
-	return strings.TrimRight(c.AgentURL, "/") + path
-}
-
 func (cfg Configuration) Key(c context.Context) *datastore.Key {
 	return datastore.NewKey(c, "Configuration", "config", 0, nil)
 }
 
+// validAuth returns whether auth is the secret auth token, which must be set.
+func (cfg Configuration) validAuth(auth string) bool {
+	return cfg.SecretAuthToken != "" && hmac.Equal([]byte(auth), []byte(cfg.SecretAuthToken))
+}
+
 func getConfig(c context.Context) (Configuration, error) {
 	var cfg Configuration
 	err := datastore.Get(c, cfg.Key(c), &cfg)
+	if len(cfg.Dispensers) == 0 && cfg.AgentURL != "" {
+		cfg.Dispensers = []Dispenser{{
+			Name:         "snackman",
+			AgentURL:     cfg.AgentURL,
+			DispenseTime: cfg.DispenseTime,
+		}}
+	}
+	cfg.AgentURL, cfg.DispenseTime = "", 0
 	return cfg, err
 }
 
@@ -62,20 +107,16 @@ func Dispense(w http.ResponseWriter, r *http.Request, c context.Context) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	cfg.DispenseTime = dt
-	client := urlfetch.Client(c)
-	resp, err := client.Post(cfg.DispenseUrl(), "", nil)
+	d, err := cfg.Dispenser(r.FormValue("dispenser"))
 	if err != nil {
-		log.Criticalf(c, "Could not contact snackbot: %v", err)
-		http.Error(w, "Cannot contact snackbot, please try again later.", http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		respContent, _ := ioutil.ReadAll(resp.Body)
-		log.Criticalf(c, "Could not contact snackbot: %s", respContent)
-		http.Error(w, "Cannot contact snackbot, please try again later.", http.StatusServiceUnavailable)
+
+	d.DispenseTime = dt
+	if err := dispenseCandy(c, d); err != nil {
+		msg, code := snackbotError(err)
+		http.Error(w, msg, code)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -97,18 +138,53 @@ func Configure(w http.ResponseWriter, r *http.Request, c context.Context) {
 	}
 
 	type ConfigPageParams struct {
-		Message string
-		Config  Configuration
+		Message  string
+		Config   Configuration
+		Problems []string
 	}
 
 	var renderParams ConfigPageParams
 	if r.Method == "POST" {
-		cfg.AgentURL = r.FormValue("agent-url")
 		cfg.SecretAuthToken = r.FormValue("secret-token")
-		cfg.DispenseTime, err = time.ParseDuration(r.FormValue("dispense-time"))
-		if err == nil && (cfg.DispenseTime <= 0 || cfg.DispenseTime >= 30*time.Second) {
-			err = fmt.Errorf("Dispense time is unreasonable: %v", cfg.DispenseTime)
+
+		names, locations := r.Form["dispenser-name"], r.Form["dispenser-location"]
+		urls, times := r.Form["dispenser-url"], r.Form["dispenser-time"]
+		secrets, capacities := r.Form["dispenser-secret"], r.Form["dispenser-capacity"]
+		presence, kiosks := r.Form["dispenser-presence"], r.Form["dispenser-kiosk"]
+		if len(names) != len(locations) || len(names) != len(urls) || len(names) != len(times) ||
+			len(names) != len(secrets) || len(names) != len(capacities) || len(names) != len(presence) ||
+			len(names) != len(kiosks) {
+			log.Errorf(c, "Dispenser forms don't match:\nname: %q\nlocation: %q\nurl: %q\ntime: %q",
+				names, locations, urls, times)
+			http.Error(w, "dispenser lists should all match", http.StatusBadRequest)
+			return
+		}
+		cfg.Dispensers = nil
+		for idx := range names {
+			if names[idx] == "" && urls[idx] == "" {
+				continue
+			}
+			d := Dispenser{
+				Name:            names[idx],
+				Location:        locations[idx],
+				AgentURL:        urls[idx],
+				AgentSecret:     secrets[idx],
+				RequirePresence: presence[idx] != "",
+				KioskToken:      kiosks[idx],
+			}
+			d.DispenseTime, err = time.ParseDuration(times[idx])
+			if err == nil && capacities[idx] != "" {
+				d.Capacity, err = time.ParseDuration(capacities[idx])
+			}
+			if err == nil {
+				err = d.validate()
+			}
+			if err != nil {
+				break
+			}
+			cfg.Dispensers = append(cfg.Dispensers, d)
 		}
+
 		usernames := r.Form["username"]
 		useremails := r.Form["useremail"]
 		if len(usernames) != len(useremails) {
@@ -127,6 +203,69 @@ func Configure(w http.ResponseWriter, r *http.Request, c context.Context) {
 			cfg.GithubUsers = append(cfg.GithubUsers, GithubUserInfo{Username: username, Email: email})
 		}
 
+		repoNames, repoSecrets := r.Form["repo-name"], r.Form["repo-secret"]
+		repoEvents, repoCredits, repoBranches := r.Form["repo-events"], r.Form["repo-credits"], r.Form["repo-branches"]
+		if len(repoNames) != len(repoSecrets) || len(repoNames) != len(repoEvents) ||
+			len(repoNames) != len(repoCredits) || len(repoNames) != len(repoBranches) {
+			log.Errorf(c, "Repository forms don't match:\nname: %q\nevents: %q\ncredits: %q\nbranches: %q",
+				repoNames, repoEvents, repoCredits, repoBranches)
+			http.Error(w, "repository lists should all match", http.StatusBadRequest)
+			return
+		}
+		cfg.GithubRepos = nil
+		for idx := range repoNames {
+			if strings.TrimSpace(repoNames[idx]) == "" {
+				continue
+			}
+			repo := GithubRepo{
+				Name:     strings.TrimSpace(repoNames[idx]),
+				Secret:   repoSecrets[idx],
+				Events:   strings.Join(splitList(repoEvents[idx]), ", "),
+				Branches: strings.Join(splitList(repoBranches[idx]), ", "),
+			}
+			var err2 error
+			if repoCredits[idx] != "" {
+				repo.Credits, err2 = strconv.Atoi(strings.TrimSpace(repoCredits[idx]))
+			}
+			if err2 == nil {
+				err2 = repo.validate()
+			}
+			if err2 != nil && err == nil {
+				err = err2
+			}
+			cfg.GithubRepos = append(cfg.GithubRepos, repo)
+		}
+
+		cfg.GithubToken = r.FormValue("github-token")
+		cfg.SlackSigningSecret = r.FormValue("slack-signing-secret")
+		cfg.SlackBotToken = r.FormValue("slack-bot-token")
+		givers, err2 := parseEmailList(r.FormValue("kudos-givers"))
+		if err2 != nil && err == nil {
+			err = fmt.Errorf("Bad kudos givers: %v", err2)
+		}
+		cfg.KudosGivers = givers
+		cfg.KudosDomains = splitList(r.FormValue("kudos-domains"))
+		cfg.Penalties = r.Form["penalties"]
+		cfg.BuildBranches = splitList(r.FormValue("build-branches"))
+		cfg.GithubIgnoredUsers = splitList(r.FormValue("github-ignored-users"))
+		cfg.GithubRequireApproval = r.FormValue("github-require-approval") != ""
+		cfg.GithubExcludedRepos = splitList(r.FormValue("github-excluded-repos"))
+		cfg.GithubExcludedBranches = splitList(r.FormValue("github-excluded-branches"))
+		cfg.GithubOptOutLabels = splitList(r.FormValue("github-opt-out-labels"))
+		cfg.ReviewMinComments, err2 = formInt(r, "review-min-comments")
+		if err2 != nil && err == nil {
+			err = err2
+		}
+		cfg.ReviewTrivialLines, err2 = formInt(r, "review-trivial-lines")
+		if err2 != nil && err == nil {
+			err = err2
+		}
+		if n, err2 := strconv.Atoi(r.FormValue("kudos-allowance")); err2 == nil && n >= 0 {
+			cfg.KudosAllowance = n
+		} else if err == nil {
+			err = fmt.Errorf("Bad kudos allowance: %q", r.FormValue("kudos-allowance"))
+		}
+
 		if err == nil {
 			_, err = datastore.Put(c, cfg.Key(c), &cfg)
 		}
@@ -140,7 +279,21 @@ func Configure(w http.ResponseWriter, r *http.Request, c context.Context) {
 		}
 	}
 	renderParams.Config = cfg
+	renderParams.Problems = cfg.dispenserProblems()
 	if err := configHtmlTpl.Execute(w, renderParams); err != nil {
 		log.Criticalf(c, "Failed to render config page: %v", err)
 	}
 }
+
+// formInt parses an optional non-negative number from the form.
+func formInt(r *http.Request, name string) (int, error) {
+	v := strings.TrimSpace(r.FormValue(name))
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Bad %s: %q", name, v)
+	}
+	return n, nil
+}
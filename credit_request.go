@@ -0,0 +1,303 @@
+package chompy
+
+import (
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// CreditRequest is one user asking another (or any admin) for credits.
+type CreditRequest struct {
+	From    string // who is asking
+	To      string // who is being asked, empty for any admin
+	Num     int
+	Message string
+
+	Status     string // one of the CreditRequest* constants
+	Created    time.Time
+	Resolved   time.Time
+	ResolvedBy string
+}
+
+const (
+	CreditRequestPending  = "pending"
+	CreditRequestApproved = "approved"
+	CreditRequestDeclined = "declined"
+)
+
+func (cr CreditRequest) Recipient() string {
+	if cr.To == "" {
+		return "the chompy admins"
+	}
+	return cr.To
+}
+
+// CanResolve returns whether u may approve or decline the request.  Admins
+// can't approve their own requests to the admins.
+func (cr CreditRequest) CanResolve(u *user.User) bool {
+	if u == nil || cr.Status != CreditRequestPending {
+		return false
+	}
+	return u.Email == cr.To || (cr.To == "" && u.Admin && u.Email != cr.From)
+}
+
+type CreditRequestId int64
+
+func (id CreditRequestId) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "credit_requests", "", int64(id), nil)
+}
+
+func loadCreditRequest(c context.Context, id CreditRequestId) (CreditRequest, error) {
+	var cr CreditRequest
+	err := datastore.Get(c, id.Key(c), &cr)
+	return cr, err
+}
+
+func pendingCreditRequests(c context.Context, field, email string) ([]CreditRequestId, []CreditRequest, error) {
+	var requests []CreditRequest
+	keys, err := datastore.NewQuery("credit_requests").
+		Filter(field+" =", email).
+		Filter("Status =", CreditRequestPending).
+		Order("-Created").
+		GetAll(c, &requests)
+	var ids []CreditRequestId
+	for _, key := range keys {
+		ids = append(ids, CreditRequestId(key.IntID()))
+	}
+	return ids, requests, err
+}
+
+// PendingCreditRequest pairs a request with its id for rendering.
+type PendingCreditRequest struct {
+	Id CreditRequestId
+	CreditRequest
+}
+
+// creditRequestsFor returns the pending requests that u has been asked to
+// resolve and the ones that u is waiting on.
+func creditRequestsFor(c context.Context, u *user.User) (incoming, outgoing []PendingCreditRequest, err error) {
+	pair := func(ids []CreditRequestId, requests []CreditRequest) []PendingCreditRequest {
+		var pending []PendingCreditRequest
+		for i := range ids {
+			pending = append(pending, PendingCreditRequest{ids[i], requests[i]})
+		}
+		return pending
+	}
+	ids, requests, err := pendingCreditRequests(c, "To", u.Email)
+	if err != nil {
+		return nil, nil, err
+	}
+	incoming = pair(ids, requests)
+	if u.Admin {
+		ids, requests, err = pendingCreditRequests(c, "To", "")
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, cr := range pair(ids, requests) {
+			if cr.CanResolve(u) {
+				incoming = append(incoming, cr)
+			}
+		}
+	}
+	ids, requests, err = pendingCreditRequests(c, "From", u.Email)
+	if err != nil {
+		return nil, nil, err
+	}
+	return incoming, pair(ids, requests), nil
+}
+
+// AskForCredits creates a credit request and notifies whoever is asked.
+func AskForCredits(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+
+	rawemail, numstr, msg := r.FormValue("email"), r.FormValue("num"), r.FormValue("msg")
+	num, err := strconv.Atoi(numstr)
+	if err != nil || num <= 0 {
+		log.Errorf(c, "Bad inputs: email=%q numstr=%q err=%v", rawemail, numstr, err)
+		http.Error(w, "Bad inputs", http.StatusBadRequest)
+		return
+	}
+	to := ""
+	if rawemail != "" && rawemail != "admin" {
+		rawemail = strings.Replace(rawemail, "(", "<", -1)
+		rawemail = strings.Replace(rawemail, ")", ">", -1)
+		addr, err := netmail.ParseAddress(rawemail)
+		if err != nil {
+			log.Errorf(c, "Bad inputs: email=%q err=%v", rawemail, err)
+			http.Error(w, "Bad inputs", http.StatusBadRequest)
+			return
+		}
+		to = addr.Address
+	}
+	if to == u.Email {
+		http.Error(w, "Asking yourself?  Really?", http.StatusBadRequest)
+		return
+	}
+
+	cr := CreditRequest{
+		From:    u.Email,
+		To:      to,
+		Num:     num,
+		Message: msg,
+		Status:  CreditRequestPending,
+		Created: time.Now(),
+	}
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, "credit_requests", nil), &cr)
+	if err != nil {
+		log.Criticalf(c, "Failed to save credit request %#v: %v", cr, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q asked %q for %d credits: %q", cr.From, cr.Recipient(), cr.Num, cr.Message)
+
+	data := map[string]interface{}{
+		"from":        cr.From,
+		"N":           cr.Num,
+		"message":     cr.Message,
+		"request_url": fmt.Sprintf("http://%s/ask/%d", r.Host, key.IntID()),
+	}
+	emailMessage := &mail.Message{
+		Sender:   fmt.Sprintf("Chompy <notify@%s.appspotmail.com>", appengine.AppID(c)),
+		Subject:  fmt.Sprintf("%s is asking for candy", cr.From),
+		Body:     renderTemplateOrDie(creditRequestEmailTextTpl, data),
+		HTMLBody: renderTemplateOrDie(creditRequestEmailHtmlTpl, data),
+	}
+	if to == "" {
+		err = mail.SendToAdmins(c, emailMessage)
+	} else {
+		emailMessage.To = []string{to}
+		err = mail.Send(c, emailMessage)
+	}
+	if err != nil {
+		log.Errorf(c, "Couldn't send email for credit request %v: %v", key, err)
+		http.Error(w, "Request saved, but notification email failed.  "+
+			"Tell them to check their chompy page", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Asked %s for %d credits", cr.Recipient(), cr.Num)
+}
+
+func ShowCreditRequest(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil {
+		url, _ := user.LoginURL(c, r.URL.String())
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	id, cr, ok := loadCreditRequestParam(w, c, p)
+	if !ok {
+		return
+	}
+	if u.Email != cr.From && u.Email != cr.To && !u.Admin {
+		http.Error(w, "No such request", http.StatusNotFound)
+		return
+	}
+
+	params := struct {
+		Id         CreditRequestId
+		Request    CreditRequest
+		CanResolve bool
+	}{id, cr, cr.CanResolve(u)}
+	if err := creditRequestHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render credit request template: %v", err)
+	}
+}
+
+// ResolveCreditRequest approves or declines a credit request.  Approving it
+// donates the approver's own credits to the requester.
+func ResolveCreditRequest(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	id, _, ok := loadCreditRequestParam(w, c, p)
+	if !ok {
+		return
+	}
+
+	status := CreditRequestDeclined
+	if r.FormValue("action") == "approve" {
+		status = CreditRequestApproved
+	}
+
+	// Mark the request resolved first so that it can't be approved twice.
+	var cr CreditRequest
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, id.Key(c), &cr); err != nil {
+			return err
+		}
+		if !cr.CanResolve(u) {
+			return errCannotResolve
+		}
+		cr.Status, cr.Resolved, cr.ResolvedBy = status, time.Now(), u.Email
+		_, err := datastore.Put(c, id.Key(c), &cr)
+		return err
+	}, nil)
+	if err == errCannotResolve {
+		http.Error(w, "This request can't be resolved by you", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to resolve credit request %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if status == CreditRequestApproved {
+		donated, code, err := donateRewards(c, u.Email, []string{cr.From}, cr.Message, nil, cr.Num)
+		if err != nil {
+			// Put the request back so that it can be approved later.
+			cr.Status, cr.Resolved, cr.ResolvedBy = CreditRequestPending, time.Time{}, ""
+			if _, err := datastore.Put(c, id.Key(c), &cr); err != nil {
+				log.Criticalf(c, "Failed to reopen credit request %d: %v", id, err)
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if err := sendDonationEmail(c, r, u.Email, cr.From, cr.Message, len(donated)); err != nil {
+			log.Errorf(c, "Couldn't send email for donation: %v", err)
+		}
+	}
+
+	log.Infof(c, "%q %s credit request %d from %q for %d credits",
+		u.Email, status, id, cr.From, cr.Num)
+	http.Redirect(w, r, home, http.StatusSeeOther)
+}
+
+var errCannotResolve = fmt.Errorf("Cannot resolve credit request")
+
+func loadCreditRequestParam(w http.ResponseWriter, c context.Context, p martini.Params) (CreditRequestId, CreditRequest, bool) {
+	intId, err := strconv.ParseInt(p["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "No such request", http.StatusNotFound)
+		return 0, CreditRequest{}, false
+	}
+	id := CreditRequestId(intId)
+	cr, err := loadCreditRequest(c, id)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "No such request", http.StatusNotFound)
+		return 0, cr, false
+	} else if err != nil {
+		log.Criticalf(c, "Failed to read credit request %s: %v", p["id"], err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return 0, cr, false
+	}
+	return id, cr, true
+}
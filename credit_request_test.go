@@ -0,0 +1,31 @@
+package chompy
+
+import (
+	"testing"
+
+	"google.golang.org/appengine/user"
+)
+
+func TestCanResolve(t *testing.T) {
+	admin := &user.User{Email: "admin@acme.com", Admin: true}
+	bob := &user.User{Email: "bob@acme.com"}
+	tests := []struct {
+		name string
+		cr   CreditRequest
+		u    *user.User
+		want bool
+	}{
+		{"recipient", CreditRequest{From: "alice@acme.com", To: "bob@acme.com", Status: CreditRequestPending}, bob, true},
+		{"someone else", CreditRequest{From: "alice@acme.com", To: "carol@acme.com", Status: CreditRequestPending}, bob, false},
+		{"admin for the admins", CreditRequest{From: "alice@acme.com", Status: CreditRequestPending}, admin, true},
+		{"non-admin for the admins", CreditRequest{From: "alice@acme.com", Status: CreditRequestPending}, bob, false},
+		{"admin's own request", CreditRequest{From: "admin@acme.com", Status: CreditRequestPending}, admin, false},
+		{"already resolved", CreditRequest{From: "alice@acme.com", To: "bob@acme.com"}, bob, false},
+		{"signed out", CreditRequest{From: "alice@acme.com", Status: CreditRequestPending}, nil, false},
+	}
+	for _, test := range tests {
+		if got := test.cr.CanResolve(test.u); got != test.want {
+			t.Errorf("%s: CanResolve = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
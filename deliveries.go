@@ -0,0 +1,390 @@
+package chompy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// Deliveries are kept this long, and bodies bigger than maxDeliveryBody
+// aren't kept at all, to stay under the datastore's entity size limit.
+// Neither are the bodies of deliveries that weren't authenticated, since
+// anyone can send those.
+const (
+	deliveryRetention = 30 * 24 * time.Hour
+	maxDeliveryBody   = 900 << 10
+)
+
+// The secret auth token is replaced with this before deliveries are stored,
+// and put back when they're replayed.
+const redactedSecret = "REDACTED"
+
+// A WebhookDelivery is a webhook received by chompy, kept so that missing
+// credits can be tracked down and the webhook replayed.
+type WebhookDelivery struct {
+	Received   time.Time
+	Handler    string   // which of deliveryHandlers received it
+	Host       string   `datastore:",noindex"` // used in links in emails
+	Url        string   `datastore:",noindex"`
+	Event      string   // github's event type, if any
+	RemoteAddr string   `datastore:",noindex"`
+	Headers    []string `datastore:",noindex"` // "Name: value"
+	Body       []byte   `datastore:",noindex"` // only if the signature was valid
+	Truncated  bool     `datastore:",noindex"` // the body was too big to keep
+
+	// Results of the latest time it was handled.
+	Signature string   `datastore:",noindex"` // valid, invalid, or "" if not checked
+	Status    int      `datastore:",noindex"`
+	Response  string   `datastore:",noindex"`
+	Rewards   []string `datastore:",noindex"` // uids of granted rewards
+	Replays   int      `datastore:",noindex"`
+	Replayed  time.Time
+}
+
+type WebhookDeliveryId int64
+
+func (id WebhookDeliveryId) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "webhook_deliveries", "", int64(id), nil)
+}
+
+// WebhookDeliveryEntry pairs a delivery with its id for rendering.
+type WebhookDeliveryEntry struct {
+	Id WebhookDeliveryId
+	WebhookDelivery
+}
+
+type webhookHandler func(w http.ResponseWriter, r *http.Request, c context.Context)
+
+// Webhook handlers whose deliveries are logged, by name.
+var deliveryHandlers = map[string]webhookHandler{
+	"webhook": HandleWebhook,
+	"jenkins": HandleJenkins,
+	"build":   HandleBuild,
+}
+
+// deliveryNotes collects what a webhook handler did, through its context.
+type deliveryNotes struct {
+	Signature string
+	Rewards   []string
+}
+
+type deliveryNotesKey struct{}
+
+func withDeliveryNotes(c context.Context) (context.Context, *deliveryNotes) {
+	notes := &deliveryNotes{}
+	return context.WithValue(c, deliveryNotesKey{}, notes), notes
+}
+
+// noteSignature records whether a webhook's signature or auth token was valid.
+func noteSignature(c context.Context, valid bool) {
+	if notes, ok := c.Value(deliveryNotesKey{}).(*deliveryNotes); ok {
+		notes.Signature = "invalid"
+		if valid {
+			notes.Signature = "valid"
+		}
+	}
+}
+
+// noteReward records that a webhook granted a reward.
+func noteReward(c context.Context, uid Uid) {
+	if notes, ok := c.Value(deliveryNotesKey{}).(*deliveryNotes); ok {
+		notes.Rewards = append(notes.Rewards, string(uid))
+	}
+}
+
+// responseRecorder keeps the start of a response for the delivery log.
+type responseRecorder struct {
+	*statusRecorder
+	body bytes.Buffer
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.body.Len() < 1000 {
+		rec.body.Write(data)
+	}
+	return rec.statusRecorder.Write(data)
+}
+
+// logDeliveries wraps the named webhook handler to log its deliveries.
+func logDeliveries(name string) webhookHandler {
+	return func(w http.ResponseWriter, r *http.Request, c context.Context) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Criticalf(c, "Failed to read request body: %v", err)
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		d := WebhookDelivery{
+			Received:   time.Now(),
+			Handler:    name,
+			Host:       r.Host,
+			Url:        r.URL.RequestURI(),
+			Event:      r.Header.Get("X-GitHub-Event"),
+			RemoteAddr: r.RemoteAddr,
+			Body:       body,
+		}
+		for name, values := range r.Header {
+			for _, v := range values {
+				d.Headers = append(d.Headers, name+": "+v)
+			}
+		}
+		sort.Strings(d.Headers)
+		if len(body) > maxDeliveryBody {
+			d.Body, d.Truncated = nil, true
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rec := &responseRecorder{statusRecorder: &statusRecorder{ResponseWriter: w}}
+		nc, notes := withDeliveryNotes(c)
+		deliveryHandlers[name](rec, r, nc)
+		d.record(rec, notes)
+		if d.Signature != "valid" {
+			d.Body = nil
+		}
+		d.Url, d.Body = withAuth(d.Url, d.Body, redactedSecret)
+
+		if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "webhook_deliveries", nil), &d); err != nil {
+			log.Errorf(c, "Failed to log webhook delivery: %v", err)
+		}
+	}
+}
+
+func (d *WebhookDelivery) record(rec *responseRecorder, notes *deliveryNotes) {
+	d.Status = rec.status
+	if d.Status == 0 {
+		d.Status = http.StatusOK
+	}
+	d.Response = rec.body.String()
+	d.Signature = notes.Signature
+	d.Rewards = notes.Rewards
+}
+
+// Replayable returns whether the delivery was kept whole, so that it can be
+// replayed.
+func (d WebhookDelivery) Replayable() bool {
+	return d.Signature == "valid" && !d.Truncated && deliveryHandlers[d.Handler] != nil
+}
+
+// withAuth returns a delivery's url and body with the auth token that the
+// jenkins, build and generic webhooks carry, if any, replaced by auth.
+func withAuth(rawurl string, body []byte, auth string) (string, []byte) {
+	if u, err := url.Parse(rawurl); err == nil {
+		q := u.Query()
+		if _, ok := q["auth"]; ok {
+			q.Set("auth", auth)
+			u.RawQuery = q.Encode()
+			rawurl = u.RequestURI()
+		}
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return rawurl, body
+	}
+	found := false
+	for name := range fields {
+		// Like encoding/json, the handlers don't care about case.
+		if strings.EqualFold(name, "auth") {
+			fields[name], _ = json.Marshal(auth)
+			found = true
+		}
+	}
+	if found {
+		if b, err := json.Marshal(fields); err == nil {
+			body = b
+		}
+	}
+	return rawurl, body
+}
+
+// request rebuilds the request a delivery was, with the given auth token in
+// place of the redacted one.
+func (d WebhookDelivery) request(secret string) (*http.Request, error) {
+	rawurl, body := withAuth(d.Url, d.Body, secret)
+	r, err := http.NewRequest("POST", rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range d.Headers {
+		if parts := strings.SplitN(h, ": ", 2); len(parts) == 2 {
+			r.Header.Add(parts[0], parts[1])
+		}
+	}
+	r.Host = d.Host
+	r.RemoteAddr = d.RemoteAddr
+	return r, nil
+}
+
+// ShowDeliveries lists recent webhook deliveries for admins.
+func ShowDeliveries(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	q := datastore.NewQuery("webhook_deliveries").Order("-Received").Limit(200)
+	if handler := r.FormValue("handler"); handler != "" {
+		q = q.Filter("Handler =", handler)
+	}
+	var deliveries []WebhookDelivery
+	keys, err := q.GetAll(c, &deliveries)
+	if err != nil {
+		log.Criticalf(c, "Failed to load webhook deliveries: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	var entries []WebhookDeliveryEntry
+	for i, key := range keys {
+		entries = append(entries, WebhookDeliveryEntry{WebhookDeliveryId(key.IntID()), deliveries[i]})
+	}
+	if err := deliveriesHtmlTpl.Execute(w, entries); err != nil {
+		log.Criticalf(c, "Failed to render deliveries template: %v", err)
+	}
+}
+
+func loadDelivery(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) (WebhookDeliveryEntry, bool) {
+	n, err := strconv.ParseInt(p["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return WebhookDeliveryEntry{}, false
+	}
+	entry := WebhookDeliveryEntry{Id: WebhookDeliveryId(n)}
+	if err := datastore.Get(c, entry.Id.Key(c), &entry.WebhookDelivery); err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return entry, false
+	} else if err != nil {
+		log.Criticalf(c, "Failed to load webhook delivery %d: %v", n, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return entry, false
+	}
+	return entry, true
+}
+
+// ShowDelivery shows a webhook delivery's headers and body.
+func ShowDelivery(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	entry, ok := loadDelivery(w, r, c, p)
+	if !ok {
+		return
+	}
+	if err := deliveryHtmlTpl.Execute(w, entry); err != nil {
+		log.Criticalf(c, "Failed to render delivery template: %v", err)
+	}
+}
+
+// ReplayDelivery runs a stored webhook delivery through its handler again,
+// e.g. after fixing a github user mapping.  Rewards that were already granted
+// are rejected as duplicates, as they would be if github redelivered it.
+func ReplayDelivery(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	entry, ok := loadDelivery(w, r, c, p)
+	if !ok {
+		return
+	}
+	if !entry.Replayable() {
+		http.Error(w, "This delivery can't be replayed", http.StatusBadRequest)
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+	req, err := entry.request(cfg.SecretAuthToken)
+	if err != nil {
+		log.Errorf(c, "Can't rebuild webhook delivery %d: %v", entry.Id, err)
+		http.Error(w, "This delivery can't be replayed", http.StatusBadRequest)
+		return
+	}
+	if req.Host == "" {
+		req.Host = r.Host // Logged before hosts were kept.
+	}
+
+	log.Infof(c, "%q is replaying webhook delivery %d", u.Email, entry.Id)
+	rec := &responseRecorder{statusRecorder: &statusRecorder{ResponseWriter: httptest.NewRecorder()}}
+	nc, notes := withDeliveryNotes(c)
+	deliveryHandlers[entry.Handler](rec, req, nc)
+
+	d := &entry.WebhookDelivery
+	rewards := d.Rewards
+	d.record(rec, notes)
+	// Keep the rewards granted the first time around too.
+	for _, uid := range rewards {
+		if !containsString(d.Rewards, uid) {
+			d.Rewards = append(d.Rewards, uid)
+		}
+	}
+	d.Replays++
+	d.Replayed = time.Now()
+	if _, err := datastore.Put(c, entry.Id.Key(c), d); err != nil {
+		log.Criticalf(c, "Failed to save webhook delivery %d: %v", entry.Id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/deliveries/%d", entry.Id), http.StatusSeeOther)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpireDeliveries deletes webhook deliveries older than deliveryRetention.
+// It's run daily by cron.
+func ExpireDeliveries(w http.ResponseWriter, r *http.Request, c context.Context) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		if u := user.Current(c); u == nil || !u.Admin {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	deleted := 0
+	for {
+		keys, err := datastore.NewQuery("webhook_deliveries").
+			Filter("Received <", time.Now().Add(-deliveryRetention)).
+			KeysOnly().
+			Limit(500).
+			GetAll(c, nil)
+		if err == nil && len(keys) > 0 {
+			err = datastore.DeleteMulti(c, keys)
+		}
+		if err != nil {
+			log.Criticalf(c, "Failed to expire webhook deliveries: %v", err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		deleted += len(keys)
+		if len(keys) < 500 {
+			break
+		}
+	}
+	log.Infof(c, "Deleted %d old webhook deliveries", deleted)
+	fmt.Fprintf(w, "Deleted %d", deleted)
+}
@@ -0,0 +1,55 @@
+package chompy
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestDeliveryRequest(t *testing.T) {
+	d := WebhookDelivery{
+		Host:       "chompy.example.com",
+		Url:        "/ci/jenkins?auth=" + redactedSecret,
+		RemoteAddr: "1.2.3.4",
+		Headers: []string{
+			"Content-Type: application/json",
+			"User-Agent: GitHub-Hookshot/abc",
+			"X-Hub-Signature: sha1=1234",
+		},
+		Body: []byte(`{"zen":"Keep it logically awesome."}`),
+	}
+	r, err := d.request("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.URL.Query().Get("auth") != "secret" || r.Host != "chompy.example.com" || r.RemoteAddr != "1.2.3.4" ||
+		r.Header.Get("User-Agent") != "GitHub-Hookshot/abc" || r.Header.Get("X-Hub-Signature") != "sha1=1234" {
+		t.Errorf("Wrong request: %#v", r)
+	}
+	if body, _ := ioutil.ReadAll(r.Body); string(body) != string(d.Body) {
+		t.Errorf("Wrong body: %q", body)
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	for _, test := range []struct {
+		url, body         string
+		wantUrl, wantBody string
+	}{
+		{"/ci/jenkins?auth=hunter2", `{"name":"build"}`,
+			"/ci/jenkins?auth=REDACTED", `{"name":"build"}`},
+		{"/webhook", `{"Auth":"hunter2","Email":"a@example.com"}`,
+			"/webhook", `{"Auth":"REDACTED","Email":"a@example.com"}`},
+		{"/ci/build", `{"auth":"hunter2"}`,
+			"/ci/build", `{"auth":"REDACTED"}`},
+		// Github webhooks are signed, so their bodies must be left alone.
+		{"/webhook", `{"action": "closed", "number": 1}`,
+			"/webhook", `{"action": "closed", "number": 1}`},
+		{"/webhook", `not json`, "/webhook", `not json`},
+	} {
+		url, body := withAuth(test.url, []byte(test.body), redactedSecret)
+		if url != test.wantUrl || string(body) != test.wantBody {
+			t.Errorf("withAuth(%q, %q) = %q, %q; want %q, %q",
+				test.url, test.body, url, body, test.wantUrl, test.wantBody)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package chompy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	"github.com/augustoroman/chompy/snackbot"
+)
+
+// Dispenser is a single candy machine and the snackbot agent that drives it.
+type Dispenser struct {
+	Name         string
+	Location     string // e.g. "2nd floor kitchen"
+	AgentURL     string
+	DispenseTime time.Duration
+
+	// Secret shared with the agent to sign requests.  It must match
+	// SHARED_SECRET in the agent code.
+	AgentSecret string
+
+	// How long the motor can run on a full load of candy, 0 if unknown.
+	// Used to estimate how much candy is left.
+	Capacity time.Duration
+
+	// Whether dispensing needs the code shown at the machine by the agent's
+	// /presence page, so that candy can't be dispensed to an empty office.
+	RequirePresence bool
+
+	// Secret in the URL of the kiosk page for this dispenser, empty if it
+	// has no kiosk.
+	KioskToken string
+}
+
+// Snackbot returns a client for the dispenser's agent.
+func (d Dispenser) Snackbot() *snackbot.Client {
+	client := snackbot.New(d.AgentURL, nil)
+	client.NewHTTP = urlfetch.Client
+	client.Secret = d.AgentSecret
+	client.OnRequest = observeAgentRequest
+	return client
+}
+
+// dispenserProblems explains why configured dispensers can't dispense, e.g.
+// the one carried over from before there were several, which has no agent
+// secret.
+func (cfg Configuration) dispenserProblems() []string {
+	var problems []string
+	for _, d := range cfg.Dispensers {
+		if d.AgentSecret == "" {
+			problems = append(problems, fmt.Sprintf("Dispenser %q can't dispense until it has an agent secret: "+
+				"set one on /config and the same SHARED_SECRET in its agent code.", d.Name))
+		} else if err := d.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+func (d Dispenser) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("Dispenser at %q has no name", d.AgentURL)
+	}
+	if d.AgentURL == "" {
+		return fmt.Errorf("Dispenser %q has no agent URL", d.Name)
+	}
+	if d.AgentSecret == "" {
+		return fmt.Errorf("Dispenser %q has no agent secret", d.Name)
+	}
+	if d.DispenseTime <= 0 || d.DispenseTime > snackbot.MaxDispenseTime {
+		return fmt.Errorf("Dispense time for %q is unreasonable: %v", d.Name, d.DispenseTime)
+	}
+	return nil
+}
+
+// PresencePage is the link to d's agent page that shows its presence codes.
+func (d Dispenser) PresencePage() string {
+	return snackbot.PresencePageURL(d.AgentURL, d.AgentSecret)
+}
+
+// presenceOK returns whether code is d's current presence code, or d doesn't
+// need one.
+func presenceOK(d Dispenser, code string) bool {
+	return !d.RequirePresence || snackbot.CheckPresenceCode(d.AgentSecret, strings.TrimSpace(code), time.Now())
+}
+
+// checkPresence makes sure that whoever is dispensing from d is standing at
+// it, if d requires that.  It reports an error and returns false otherwise.
+func checkPresence(w http.ResponseWriter, r *http.Request, d Dispenser) bool {
+	if presenceOK(d, r.FormValue("presence")) {
+		return true
+	}
+	countDispense("no_presence")
+	http.Error(w, fmt.Sprintf("Enter the code shown on %s to dispense", d.Name), http.StatusForbidden)
+	return false
+}
+
+// Dispenser returns the dispenser with the given name, or the first one if
+// name is empty.
+func (cfg Configuration) Dispenser(name string) (Dispenser, error) {
+	if len(cfg.Dispensers) == 0 {
+		return Dispenser{}, fmt.Errorf("No dispensers configured")
+	}
+	if name == "" {
+		return cfg.Dispensers[0], nil
+	}
+	for _, d := range cfg.Dispensers {
+		if strings.EqualFold(d.Name, name) {
+			return d, nil
+		}
+	}
+	return Dispenser{}, fmt.Errorf("No such dispenser: %q", name)
+}
+
+// DispenserStatus is the health of a single dispenser.
+type DispenserStatus struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+	Online   bool   `json:"online"`
+	Error    string `json:"error,omitempty"`
+
+	RequiresPresence bool `json:"requires_presence"`
+}
+
+// dispenserStatuses checks all dispensers in parallel.
+func dispenserStatuses(c context.Context, dispensers []Dispenser) []DispenserStatus {
+	statuses := make([]DispenserStatus, len(dispensers))
+	var wg sync.WaitGroup
+	for i, d := range dispensers {
+		statuses[i] = DispenserStatus{Name: d.Name, Location: d.Location, RequiresPresence: d.RequirePresence}
+		wg.Add(1)
+		go func(i int, d Dispenser) {
+			defer wg.Done()
+			status, err := d.Snackbot().Status(c)
+			if err != nil {
+				log.Errorf(c, "Could not get status of dispenser %q: %v", d.Name, err)
+				statuses[i].Error = err.Error()
+				return
+			}
+			statuses[i].Online = status.Online
+		}(i, d)
+	}
+	wg.Wait()
+	return statuses
+}
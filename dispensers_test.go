@@ -0,0 +1,23 @@
+package chompy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispenserProblems(t *testing.T) {
+	cfg := Configuration{Dispensers: []Dispenser{
+		{Name: "snackman", AgentURL: "https://agent.example.com/a", AgentSecret: "s3cret", DispenseTime: time.Second},
+		{Name: "legacy", AgentURL: "https://agent.example.com/b", DispenseTime: time.Second},
+		{Name: "slow", AgentURL: "https://agent.example.com/c", AgentSecret: "s3cret", DispenseTime: time.Minute},
+	}}
+	problems := cfg.dispenserProblems()
+	if len(problems) != 2 || !strings.Contains(problems[0], `"legacy"`) ||
+		!strings.Contains(problems[0], "agent secret") || !strings.Contains(problems[1], `"slow"`) {
+		t.Errorf("Wrong problems: %q", problems)
+	}
+	if problems := (Configuration{}).dispenserProblems(); len(problems) != 0 {
+		t.Errorf("No dispensers should have no problems: %q", problems)
+	}
+}
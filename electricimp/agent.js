@@ -6,12 +6,55 @@ const html = @"<!DOCTYPE html>
   </body>
 </html>";
 
+// Secret shared with chompy to sign requests.  Set this to the same value as
+// the dispenser's agent secret on chompy's /config page.
+const SHARED_SECRET = "";
+// How far (in seconds) a signed request's timestamp may be from our clock.
+const MAX_CLOCK_SKEW = 60;
+// Never run the motor longer than this, whatever we're asked.  Must match
+// snackbot.MaxDispenseTime.
+const MAX_AMOUNT = 30.0;
+
+// Where to send device telemetry, e.g. "https://your-app.appspot.com/telemetry".
+// Leave empty to not report telemetry.
+const TELEMETRY_URL = "";
+
+// Chompy's URL, e.g. "https://your-app.appspot.com".  If set, the /presence
+// page shows a QR code that opens chompy with the presence code filled in.
+// The URL must be short enough for the code to hold it, see qrEncode.
+const CHOMPY_URL = "";
+// How long each presence code is valid for; see snackbot.PresenceStep.
+const PRESENCE_STEP = 60;
+
+// How long to wait, beyond the dispense time, for the device to confirm.
+const CONFIRM_TIMEOUT = 10;
+// How long to remember finished dispenses.
+const DISPENSE_HISTORY = 3600;
+
+// Dispense id -> {state = "pending" | "done" | "failed", started, error}
+dispenses <- {};
+nextDispenseId <- 0;
+// Nonce -> time seen, for signed requests within MAX_CLOCK_SKEW.
+seenNonces <- {};
+// Number of telemetry reports sent, so that chompy can reject replays.
+telemetrySequence <- 0;
+
 http.onrequest(function(request, res){
   try {
     if (request.path == "/status") {
       status(res);
-    } else if (request.path == "/dispense") {
-      dispense(request, res);
+    } else if (request.path == "/presence") {
+      presence(request, res);
+    } else if (request.path == "/dispense" || request.path == "/dispense/status") {
+      local error = verify(request);
+      if (error != null) {
+        server.log("Agent: Rejected " + request.path + ": " + error);
+        res.send(401, error);
+      } else if (request.path == "/dispense") {
+        dispense(request, res);
+      } else {
+        dispenseStatus(request, res);
+      }
     } else if (request.path == "/") {
       res.send(200, html);
     } else {
@@ -27,6 +70,258 @@ function status(res) {
   return;
 }
 
+// presenceCode must match snackbot.PresenceCode.
+function presenceCode(step) {
+  local mac = http.hash.hmacsha256("presence\n" + step, SHARED_SECRET);
+  local n = ((mac[0] << 24) | (mac[1] << 16) | (mac[2] << 8) | mac[3]) & 0x7fffffff;
+  return format("%06d", n % 1000000);
+}
+
+// presencePageKey must match snackbot.PresencePageKey.
+function presencePageKey() {
+  return toHex(http.hash.hmacsha256("presence page", SHARED_SECRET));
+}
+
+// presence serves a page, meant for a display next to the machine, showing
+// the code people need to dispense when chompy requires a presence check.
+// It's only shown with the key from the link on chompy's /config page.
+function presence(request, res) {
+  if (SHARED_SECRET == "") {
+    res.send(503, "agent has no shared secret configured");
+    return;
+  }
+  local key = ("key" in request.query) ? request.query.key : "";
+  if (!constantTimeEquals(presencePageKey(), key)) {
+    server.log("Agent: Rejected /presence: bad key");
+    res.send(401, "bad key");
+    return;
+  }
+  local code = presenceCode(time() / PRESENCE_STEP);
+  local page = "<!DOCTYPE html><html><head><title>Chompy</title>" +
+    "<meta http-equiv='refresh' content='10'></head>" +
+    "<body style='text-align: center; font-family: sans-serif'>" +
+    "<p>Dispensing from here?  Enter this code:</p>" +
+    "<h1 style='font-size: 120px; margin: 0'>" + code + "</h1>";
+  if (CHOMPY_URL != "") {
+    local qr = qrSvg(CHOMPY_URL + "/me?presence=" + code);
+    if (qr != null) {
+      page += "<p>or scan:<br>" + qr;
+    }
+  }
+  res.header("Content-Type", "text/html");
+  res.send(200, page + "</body></html>");
+}
+
+// A minimal QR code encoder for the /presence page: byte mode, low error
+// correction, versions 1 to 5 (up to 106 bytes) and always mask 0, which any
+// scanner reads.
+const QR_DATA_CODEWORDS = [0, 19, 34, 55, 80, 108];
+const QR_EC_CODEWORDS = [0, 7, 10, 15, 20, 26];
+const QR_ALIGNMENT = [0, 0, 18, 22, 26, 30];
+
+// GF(256) tables for the Reed-Solomon error correction.
+qrExp <- array(256, 0);
+qrLog <- array(256, 0);
+local x = 1;
+for (local i = 0; i < 255; i++) {
+  qrExp[i] = x;
+  qrLog[x] = i;
+  x = x << 1;
+  if ((x & 0x100) != 0) {
+    x = x ^ 0x11d;
+  }
+}
+
+// qrSvg returns an SVG image of the QR code for text, or null if it's too
+// long.
+function qrSvg(text) {
+  local m = qrEncode(text);
+  if (m == null) {
+    server.log("Agent: " + text + " is too long for a QR code");
+    return null;
+  }
+  local n = m.len() + 8; // with the quiet zone around it
+  local path = "";
+  for (local r = 0; r < m.len(); r++) {
+    for (local c = 0; c < m.len(); c++) {
+      if (m[r][c]) {
+        path += "M" + (c + 4) + "," + (r + 4) + "h1v1h-1z";
+      }
+    }
+  }
+  return "<svg xmlns='http://www.w3.org/2000/svg' width='300' height='300' viewBox='0 0 " +
+    n + " " + n + "' shape-rendering='crispEdges'><rect width='" + n + "' height='" + n +
+    "' fill='#fff'/><path d='" + path + "'/></svg>";
+}
+
+// qrEncode returns the QR code for text as rows of booleans, true for dark.
+function qrEncode(text) {
+  local version = 0;
+  for (local v = 1; v < QR_DATA_CODEWORDS.len(); v++) {
+    if (text.len() <= QR_DATA_CODEWORDS[v] - 2) {
+      version = v;
+      break;
+    }
+  }
+  if (version == 0) {
+    return null;
+  }
+  local size = 17 + 4 * version;
+  local m = [];
+  for (local r = 0; r < size; r++) {
+    m.append(array(size, null));
+  }
+
+  qrFinder(m, 0, 0);
+  qrFinder(m, size - 7, 0);
+  qrFinder(m, 0, size - 7);
+  if (version > 1) {
+    local p = QR_ALIGNMENT[version];
+    for (local r = -2; r <= 2; r++) {
+      for (local c = -2; c <= 2; c++) {
+        m[p + r][p + c] = r == -2 || r == 2 || c == -2 || c == 2 || (r == 0 && c == 0);
+      }
+    }
+  }
+  for (local i = 8; i < size - 8; i++) {
+    m[6][i] = i % 2 == 0;
+    m[i][6] = i % 2 == 0;
+  }
+  qrFormat(m);
+
+  // Fill in the rest in two column wide zigzags from the bottom right.
+  local codewords = qrData(text, QR_DATA_CODEWORDS[version]);
+  codewords.extend(qrErrorCorrection(codewords, QR_EC_CODEWORDS[version]));
+  local bit = 0;
+  local up = true;
+  for (local col = size - 1; col > 0; col -= 2) {
+    if (col == 6) {
+      col--; // skip the timing pattern
+    }
+    for (local k = 0; k < size; k++) {
+      local row = up ? size - 1 - k : k;
+      for (local c = col; c > col - 2; c--) {
+        if (m[row][c] != null) {
+          continue;
+        }
+        local dark = false;
+        if (bit < codewords.len() * 8) {
+          dark = ((codewords[bit >> 3] >> (7 - (bit & 7))) & 1) == 1;
+        }
+        bit++;
+        m[row][c] = ((row + c) % 2 == 0) ? !dark : dark; // mask 0
+      }
+    }
+    up = !up;
+  }
+  return m;
+}
+
+// qrFinder draws a finder pattern and its separator.
+function qrFinder(m, top, left) {
+  for (local r = -1; r <= 7; r++) {
+    for (local c = -1; c <= 7; c++) {
+      if (top + r < 0 || top + r >= m.len() || left + c < 0 || left + c >= m.len()) {
+        continue;
+      }
+      m[top + r][left + c] = (r >= 0 && r <= 6 && (c == 0 || c == 6)) ||
+        (c >= 0 && c <= 6 && (r == 0 || r == 6)) || (r >= 2 && r <= 4 && c >= 2 && c <= 4);
+    }
+  }
+}
+
+// qrFormat draws the format information for low error correction and mask 0.
+function qrFormat(m) {
+  local size = m.len();
+  local format = 1 << 3;
+  local rem = format << 10;
+  for (local i = 14; i >= 10; i--) {
+    if (((rem >> i) & 1) != 0) {
+      rem = rem ^ (0x537 << (i - 10));
+    }
+  }
+  local bits = ((format << 10) | rem) ^ 0x5412;
+  for (local i = 0; i < 15; i++) {
+    local dark = ((bits >> i) & 1) == 1;
+    if (i < 6) {
+      m[i][8] = dark;
+    } else if (i < 8) {
+      m[i + 1][8] = dark;
+    } else {
+      m[size - 15 + i][8] = dark;
+    }
+    if (i < 8) {
+      m[8][size - 1 - i] = dark;
+    } else if (i < 9) {
+      m[8][15 - i] = dark;
+    } else {
+      m[8][14 - i] = dark;
+    }
+  }
+  m[size - 8][8] = true;
+}
+
+// qrData returns the count data codewords holding text.
+function qrData(text, count) {
+  local bits = [];
+  qrPut(bits, 4, 4); // byte mode
+  qrPut(bits, text.len(), 8);
+  foreach (b in text) {
+    qrPut(bits, b, 8);
+  }
+  for (local i = 0; i < 4 && bits.len() < count * 8; i++) {
+    bits.append(0);
+  }
+  while (bits.len() % 8 != 0) {
+    bits.append(0);
+  }
+  local data = [];
+  for (local i = 0; i < bits.len(); i += 8) {
+    local b = 0;
+    for (local j = 0; j < 8; j++) {
+      b = (b << 1) | bits[i + j];
+    }
+    data.append(b);
+  }
+  for (local i = 0; data.len() < count; i++) {
+    data.append(i % 2 == 0 ? 0xec : 0x11);
+  }
+  return data;
+}
+
+function qrPut(bits, value, n) {
+  for (local i = n - 1; i >= 0; i--) {
+    bits.append((value >> i) & 1);
+  }
+}
+
+function qrMul(a, b) {
+  return (a == 0 || b == 0) ? 0 : qrExp[(qrLog[a] + qrLog[b]) % 255];
+}
+
+// qrErrorCorrection returns count Reed-Solomon codewords for data.
+function qrErrorCorrection(data, count) {
+  local gen = [1];
+  for (local i = 0; i < count; i++) {
+    local next = array(gen.len() + 1, 0);
+    for (local j = 0; j < gen.len(); j++) {
+      next[j] = next[j] ^ gen[j];
+      next[j + 1] = next[j + 1] ^ qrMul(gen[j], qrExp[i]);
+    }
+    gen = next;
+  }
+  local ec = array(count, 0);
+  foreach (b in data) {
+    local factor = b ^ ec[0];
+    ec.remove(0);
+    ec.append(0);
+    for (local j = 0; j < count; j++) {
+      ec[j] = ec[j] ^ qrMul(gen[j + 1], factor);
+    }
+  }
+  return ec;
+}
+
 function dispense(request, res) {
   if(!device.isconnected()) {
     res.send(503, "device not connected");
@@ -37,9 +332,159 @@ function dispense(request, res) {
   if ("amount" in request.query) {
     amount = request.query.amount.tofloat();
   }
+  if (amount <= 0 || amount > MAX_AMOUNT) {
+    res.send(400, "bad amount");
+    return;
+  }
 
-  server.log("Agent: Dispensing for Chompy.");
-  device.send("dispense", amount);
+  forgetOldDispenses();
+  nextDispenseId++;
+  local id = format("%d-%d", time(), nextDispenseId);
+  dispenses[id] <- {state = "pending", started = time(), error = ""};
 
-  res.send(200, "");
+  server.log("Agent: Dispensing " + id + " for Chompy.");
+  device.send("dispense", {id = id, seconds = amount});
+
+  imp.wakeup(amount + CONFIRM_TIMEOUT, function() {
+    failDispense(id, "device did not confirm");
+  });
+
+  res.send(200, http.jsonencode({id = id}));
 }
+
+// verify checks that a request was signed by chompy, returning null if it was
+// or the reason it's rejected.  The signature is the hex HMAC-SHA256 of the
+// method, path, amount, timestamp and nonce separated by newlines; see
+// snackbot/sign.go.
+function verify(request) {
+  if (SHARED_SECRET == "") {
+    return "agent has no shared secret configured";
+  }
+  local headers = request.headers;
+  if (!("x-chompy-timestamp" in headers) || !("x-chompy-nonce" in headers) ||
+      !("x-chompy-signature" in headers)) {
+    return "missing signature";
+  }
+  local timestamp = headers["x-chompy-timestamp"];
+  local nonce = headers["x-chompy-nonce"];
+
+  local skew = time() - timestamp.tointeger();
+  if (skew > MAX_CLOCK_SKEW || skew < -MAX_CLOCK_SKEW) {
+    return "stale request";
+  }
+  forgetOldNonces();
+  if (nonce in seenNonces) {
+    return "replayed request";
+  }
+
+  local amount = ("amount" in request.query) ? request.query.amount : "";
+  local message = request.method + "\n" + request.path + "\n" + amount + "\n" +
+    timestamp + "\n" + nonce;
+  local expected = toHex(http.hash.hmacsha256(message, SHARED_SECRET));
+  if (!constantTimeEquals(expected, headers["x-chompy-signature"])) {
+    return "bad signature";
+  }
+
+  seenNonces[nonce] <- time();
+  return null;
+}
+
+function forgetOldNonces() {
+  local old = [];
+  foreach (nonce, seen in seenNonces) {
+    if (time() - seen > 2 * MAX_CLOCK_SKEW) {
+      old.append(nonce);
+    }
+  }
+  foreach (nonce in old) {
+    delete seenNonces[nonce];
+  }
+}
+
+function toHex(data) {
+  local hex = "";
+  foreach (b in data) {
+    hex += format("%02x", b);
+  }
+  return hex;
+}
+
+function constantTimeEquals(a, b) {
+  if (a.len() != b.len()) {
+    return false;
+  }
+  local diff = 0;
+  for (local i = 0; i < a.len(); i++) {
+    diff = diff | (a[i] ^ b[i]);
+  }
+  return diff == 0;
+}
+
+function dispenseStatus(request, res) {
+  local id = ("id" in request.query) ? request.query.id : "";
+  if (!(id in dispenses)) {
+    res.send(404, "unknown dispense");
+    return;
+  }
+  local d = dispenses[id];
+  res.send(200, http.jsonencode({id = id, state = d.state, error = d.error}));
+}
+
+function failDispense(id, error) {
+  if (id in dispenses && dispenses[id].state == "pending") {
+    server.log("Agent: Dispense " + id + " failed: " + error);
+    dispenses[id].state = "failed";
+    dispenses[id].error = error;
+  }
+}
+
+function forgetOldDispenses() {
+  local old = [];
+  foreach (id, d in dispenses) {
+    if (time() - d.started > DISPENSE_HISTORY) {
+      old.append(id);
+    }
+  }
+  foreach (id in old) {
+    delete dispenses[id];
+  }
+}
+
+device.on("dispensed", function(result) {
+  if (!(result.id in dispenses)) {
+    return;
+  }
+  if (result.ok) {
+    server.log("Agent: Dispense " + result.id + " confirmed.");
+    dispenses[result.id].state = "done";
+  } else {
+    failDispense(result.id, result.error);
+  }
+});
+
+device.ondisconnect(function() {
+  foreach (id, d in dispenses) {
+    failDispense(id, "device disconnected");
+  }
+});
+
+// Forward the device's telemetry to chompy, signed with the hex HMAC-SHA256 of
+// the body; see snackbot.SignBody.
+device.on("telemetry", function(report) {
+  if (TELEMETRY_URL == "" || SHARED_SECRET == "") {
+    return;
+  }
+  report.agent_url <- http.agenturl();
+  report.timestamp <- time();
+  report.sequence <- ++telemetrySequence;
+  local body = http.jsonencode(report);
+  local headers = {
+    "Content-Type": "application/json",
+    "X-Chompy-Signature": toHex(http.hash.hmacsha256(body, SHARED_SECRET))
+  };
+  http.post(TELEMETRY_URL, headers, body).sendasync(function(res) {
+    if (res.statuscode >= 300) {
+      server.log("Agent: Telemetry rejected (" + res.statuscode + "): " + res.body);
+    }
+  });
+});
@@ -12,10 +12,50 @@ motor <- hardware.pin9;
 motor.configure(DIGITAL_OUT);
 motor.write(0);
 
-agent.on("dispense", function(seconds) {
-    server.log("Imp Dispensing: " + seconds + " seconds");
+// Optional drop sensor (e.g. an IR break-beam across the chute) that pulls
+// pin1 low whenever a candy falls past it.  If one is fitted, set this to
+// hardware.pin1.
+dropSensor <- null;
+// How long to keep counting drops after the motor stops.
+const DROP_SETTLE_TIME = 0.5;
+
+drops <- 0;
+if (dropSensor != null) {
+    dropSensor.configure(DIGITAL_IN_PULLUP, function() {
+        if (dropSensor.read() == 0) {
+            drops++;
+        }
+    });
+}
+
+// Tells chompy (via the agent) how the machine is doing.
+function sendTelemetry(event, id, seconds, dropped) {
+    agent.send("telemetry", {
+        event = event,
+        dispense_id = id,
+        motor_seconds = seconds,
+        drops = dropped,
+        rssi = imp.rssi()
+    });
+}
+sendTelemetry("boot", "", 0, -1);
+
+agent.on("dispense", function(request) {
+    server.log("Imp Dispensing " + request.id + ": " + request.seconds + " seconds");
+    drops = 0;
     motor.write(1);
-    imp.wakeup(seconds, function(){
+    imp.wakeup(request.seconds, function(){
         motor.write(0);
+        // Only confirm once the motor has run for the full time and anything
+        // it pushed out has had time to fall past the sensor.
+        imp.wakeup(DROP_SETTLE_TIME, function() {
+            local dropped = (dropSensor == null) ? -1 : drops;
+            sendTelemetry("dispense", request.id, request.seconds, dropped);
+            if (dropped == 0) {
+                agent.send("dispensed", {id = request.id, ok = false, error = "no candy detected"});
+            } else {
+                agent.send("dispensed", {id = request.id, ok = true, error = ""});
+            }
+        });
     });
 });
@@ -0,0 +1,75 @@
+package chompy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Pull requests with this label (or any of cfg.GithubOptOutLabels) never earn
+// credits.
+const noChompyLabel = "no-chompy"
+
+// isGithubBot reports whether a github account is a bot, e.g. dependabot, or
+// one of the accounts /config says to ignore.  userType is the "type" github
+// reports for the account.
+func (cfg Configuration) isGithubBot(login, userType string) bool {
+	if userType == "Bot" || strings.HasSuffix(strings.ToLower(login), "[bot]") {
+		return true
+	}
+	for _, ignored := range cfg.GithubIgnoredUsers {
+		if strings.EqualFold(login, ignored) {
+			return true
+		}
+	}
+	return false
+}
+
+// githubExcluded says why a pull request in repo (e.g. "owner/name") against
+// branch with the given labels doesn't earn any credits, or "" if it does.
+// Excluded repos and branches may be patterns like "owner/*".
+func (cfg Configuration) githubExcluded(repo, branch string, labels []string) string {
+	for _, pattern := range cfg.GithubExcludedRepos {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(repo)); ok {
+			return fmt.Sprintf("repository %s is excluded", repo)
+		}
+	}
+	for _, pattern := range cfg.GithubExcludedBranches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return fmt.Sprintf("branch %s is excluded", branch)
+		}
+	}
+	optOuts := append([]string{noChompyLabel}, cfg.GithubOptOutLabels...)
+	for _, label := range labels {
+		for _, optOut := range optOuts {
+			if strings.EqualFold(label, optOut) {
+				return fmt.Sprintf("labeled %q", label)
+			}
+		}
+	}
+	return ""
+}
+
+// hasApproval reports whether anyone has approved a pull request, as recorded
+// from pull_request_review events.
+func hasApproval(c context.Context, prUrl string) (bool, error) {
+	n, err := datastore.NewQuery("pr_reviews").
+		Filter("PullRequest =", prUrl).
+		Filter("Approved =", true).
+		Count(c)
+	return n > 0, err
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(raw string) []string {
+	var list []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
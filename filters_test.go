@@ -0,0 +1,50 @@
+package chompy
+
+import "testing"
+
+func TestIsGithubBot(t *testing.T) {
+	cfg := Configuration{GithubIgnoredUsers: []string{"renovate"}}
+	tests := []struct {
+		login, userType string
+		want            bool
+	}{
+		{"augustoroman", "User", false},
+		{"dependabot[bot]", "Bot", true},
+		{"github-actions[bot]", "", true},
+		{"some-app", "Bot", true},
+		{"Renovate", "User", true},
+	}
+	for _, test := range tests {
+		if got := cfg.isGithubBot(test.login, test.userType); got != test.want {
+			t.Errorf("isGithubBot(%q, %q) = %v, want %v", test.login, test.userType, got, test.want)
+		}
+	}
+}
+
+func TestGithubExcluded(t *testing.T) {
+	cfg := Configuration{
+		GithubExcludedRepos:    []string{"augustoroman/website", "sandbox/*"},
+		GithubExcludedBranches: []string{"gh-pages", "release-*"},
+		GithubOptOutLabels:     []string{"chore"},
+	}
+	tests := []struct {
+		repo, branch string
+		labels       []string
+		excluded     bool
+	}{
+		{"augustoroman/chompy", "master", []string{"bug"}, false},
+		{"augustoroman/Website", "master", nil, true},
+		{"sandbox/anything", "master", nil, true},
+		{"augustoroman/chompy", "gh-pages", nil, true},
+		{"augustoroman/chompy", "release-1.2", nil, true},
+		{"augustoroman/chompy", "master", []string{"bug", "No-Chompy"}, true},
+		{"augustoroman/chompy", "master", []string{"chore"}, true},
+	}
+	for _, test := range tests {
+		why := cfg.githubExcluded(test.repo, test.branch, test.labels)
+		if (why != "") != test.excluded {
+			t.Errorf("githubExcluded(%q, %q, %q) = %q, want excluded=%v",
+				test.repo, test.branch, test.labels, why, test.excluded)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package chompy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// githubAPI is the GitHub REST API's base url.
+var githubAPI = "https://api.github.com"
+
+// githubClient reads pull requests and reviews from the GitHub REST API.
+type githubClient struct {
+	client *http.Client
+	base   string // e.g. githubAPI
+	token  string // optional, but unauthenticated requests are rate limited
+}
+
+type githubUser struct{ Login, Type string }
+
+type githubPull struct {
+	Number    int
+	HtmlUrl   string `json:"html_url"`
+	Body      string
+	User      githubUser
+	MergedAt  *time.Time `json:"merged_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Base      struct{ Ref string }
+	Labels    []struct{ Name string }
+	// Only included when getting a single pull request.
+	Additions int
+	Deletions int
+}
+
+type githubReview struct {
+	Id          int64
+	User        githubUser
+	State       string // APPROVED, COMMENTED, CHANGES_REQUESTED or DISMISSED
+	Body        string
+	SubmittedAt time.Time `json:"submitted_at"`
+}
+
+type githubComment struct {
+	Id        int64
+	User      githubUser
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// get decodes the JSON at url into v, and returns the url of the next page of
+// results, if there is one.
+func (gh githubClient) get(url string, v interface{}) (next string, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if gh.token != "" {
+		req.Header.Set("Authorization", "token "+gh.token)
+	}
+	resp, err := gh.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if len(body) > 200 {
+			body = body[:200]
+		}
+		return "", fmt.Errorf("GET %s: %s: %s", url, resp.Status, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", fmt.Errorf("GET %s: %v", url, err)
+	}
+	if m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return next, nil
+}
+
+// mergedPulls returns up to max of repo's pull requests merged since the
+// given time, most recently updated first.
+func (gh githubClient) mergedPulls(repo string, since time.Time, max int) ([]githubPull, error) {
+	var pulls []githubPull
+	url := fmt.Sprintf("%s/repos/%s/pulls?state=closed&sort=updated&direction=desc&per_page=100", gh.base, repo)
+	for url != "" {
+		var page []githubPull
+		next, err := gh.get(url, &page)
+		if err != nil {
+			return pulls, err
+		}
+		for _, pr := range page {
+			// Pull requests merged since then have been updated since too.
+			if pr.UpdatedAt.Before(since) {
+				return pulls, nil
+			}
+			if pr.MergedAt == nil || pr.MergedAt.Before(since) {
+				continue
+			}
+			if len(pulls) == max {
+				return pulls, nil
+			}
+			pulls = append(pulls, pr)
+		}
+		url = next
+	}
+	return pulls, nil
+}
+
+func (gh githubClient) pull(repo string, number int) (githubPull, error) {
+	var pr githubPull
+	_, err := gh.get(fmt.Sprintf("%s/repos/%s/pulls/%d", gh.base, repo, number), &pr)
+	return pr, err
+}
+
+func (gh githubClient) reviews(repo string, number int) ([]githubReview, error) {
+	var reviews []githubReview
+	url := fmt.Sprintf("%s/repos/%s/pulls/%d/reviews?per_page=100", gh.base, repo, number)
+	for url != "" {
+		var page []githubReview
+		next, err := gh.get(url, &page)
+		if err != nil {
+			return reviews, err
+		}
+		reviews, url = append(reviews, page...), next
+	}
+	return reviews, nil
+}
+
+func (gh githubClient) reviewComments(repo string, number int) ([]githubComment, error) {
+	var comments []githubComment
+	url := fmt.Sprintf("%s/repos/%s/pulls/%d/comments?per_page=100", gh.base, repo, number)
+	for url != "" {
+		var page []githubComment
+		next, err := gh.get(url, &page)
+		if err != nil {
+			return comments, err
+		}
+		comments, url = append(comments, page...), next
+	}
+	return comments, nil
+}
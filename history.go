@@ -0,0 +1,132 @@
+package chompy
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+func ShowRewardHistory(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	reward, err := loadReward(c, Uid(p["id"]))
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "No such reward", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to read %s: %v", p["id"], err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	params := struct {
+		Reward  Reward
+		IsAdmin bool
+	}{reward, user.IsAdmin(c)}
+	if err := rewardHistoryTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render history template: %v", err)
+	}
+}
+
+func RevokeReward(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := Uid(p["id"]).Key(c)
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var reward Reward
+		if err := datastore.Get(c, key, &reward); err != nil {
+			return err
+		}
+		if !reward.Available() {
+			return errNotAvailable
+		}
+		reward.Revoke(u.Email, r.FormValue("msg"))
+		_, err := datastore.Put(c, key, &reward)
+		return err
+	}, nil)
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		http.Error(w, "No such reward", http.StatusNotFound)
+		return
+	case errNotAvailable:
+		http.Error(w, "Not available", http.StatusGone)
+		return
+	default:
+		log.Criticalf(c, "Failed to revoke %s: %v", p["id"], err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(c, "%q revoked reward %s: %q", u.Email, p["id"], r.FormValue("msg"))
+	http.Redirect(w, r, fmt.Sprintf("/r/%s/history", p["id"]), http.StatusSeeOther)
+}
+
+var errNotAvailable = fmt.Errorf("Reward not available")
+
+// MigrateRewardHistory re-saves every reward so that any still stored with
+// the old donation slices are rewritten with a History.
+func MigrateRewardHistory(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+
+	const batchSize = 200
+	total := 0
+	q := datastore.NewQuery("rewards")
+	for {
+		var (
+			keys    []*datastore.Key
+			rewards []Reward
+		)
+		it := q.Run(c)
+		for len(keys) < batchSize {
+			var reward Reward
+			key, err := it.Next(&reward)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				log.Criticalf(c, "Failed to read rewards: %v", err)
+				http.Error(w, fmt.Sprintf("Failed after migrating %d rewards", total),
+					http.StatusInternalServerError)
+				return
+			}
+			keys = append(keys, key)
+			rewards = append(rewards, reward)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if _, err := datastore.PutMulti(c, keys, rewards); err != nil {
+			log.Criticalf(c, "Failed to save migrated rewards: %v", err)
+			http.Error(w, fmt.Sprintf("Failed after migrating %d rewards", total),
+				http.StatusInternalServerError)
+			return
+		}
+		total += len(keys)
+		if len(keys) < batchSize {
+			break
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			log.Criticalf(c, "Failed to get query cursor: %v", err)
+			http.Error(w, fmt.Sprintf("Failed after migrating %d rewards", total),
+				http.StatusInternalServerError)
+			return
+		}
+		q = datastore.NewQuery("rewards").Start(cursor)
+	}
+
+	log.Infof(c, "Migrated history for %d rewards", total)
+	fmt.Fprintf(w, "Migrated %d rewards\n", total)
+}
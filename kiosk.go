@@ -0,0 +1,424 @@
+package chompy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// Kiosk mode lets people dispense from a tablet next to the machine, signing
+// in with a badge, a QR code from their /me page or a PIN.  Badge
+// readers and QR scanners act as keyboards, so all three are just a
+// credential typed into the kiosk that maps to an email address.
+
+// How long a kiosk session lasts.  The kiosk page also signs out after
+// kioskIdleTimeout of inactivity.
+const (
+	kioskSessionLength = 2 * time.Minute
+	kioskIdleTimeout   = 30 * time.Second
+)
+
+// Digits in a kiosk PIN.  Together with the limits on failed sign-ins below,
+// guessing someone's PIN is hopeless.
+const kioskPinDigits = 8
+
+// Failed sign-ins allowed at a kiosk, and from a single client, before
+// sign-ins there are refused for the rest of kioskLockoutWindow.
+const (
+	kioskMaxFailuresPerKiosk  = 20
+	kioskMaxFailuresPerClient = 5
+	kioskLockoutWindow        = 15 * time.Minute
+)
+
+// Kinds of kiosk credentials.
+const (
+	KioskPin   = "pin"
+	KioskQR    = "qr"
+	KioskBadge = "badge"
+)
+
+// KioskCredential maps a credential to the person it identifies.  It's keyed
+// by a hash of the credential so that PINs and QR tokens aren't stored.
+type KioskCredential struct {
+	Email   string
+	Kind    string
+	Created time.Time
+}
+
+func kioskCredentialKey(c context.Context, credential string) *datastore.Key {
+	hash := sha256.Sum256([]byte(strings.TrimSpace(credential)))
+	return datastore.NewKey(c, "kiosk_credentials", hex.EncodeToString(hash[:]), 0, nil)
+}
+
+var errCredentialTaken = errors.New("already registered to someone else")
+
+// setKioskCredential registers credential for email, replacing any others of
+// the same kind.
+func setKioskCredential(c context.Context, email, kind, credential string) error {
+	old, err := datastore.NewQuery("kiosk_credentials").
+		Filter("Email =", email).
+		Filter("Kind =", kind).
+		KeysOnly().
+		GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	key := kioskCredentialKey(c, credential)
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var existing KioskCredential
+		if err := datastore.Get(c, key, &existing); err == nil && existing.Email != email {
+			return errCredentialTaken
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err := datastore.Put(c, key, &KioskCredential{email, kind, time.Now()})
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	var stale []*datastore.Key
+	for _, k := range old {
+		if !k.Equal(key) {
+			stale = append(stale, k)
+		}
+	}
+	return datastore.DeleteMulti(c, stale)
+}
+
+func randomPin() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	max := uint64(1)
+	for i := 0; i < kioskPinDigits; i++ {
+		max *= 10
+	}
+	return fmt.Sprintf("%0*d", kioskPinDigits, binary.BigEndian.Uint64(b[:])%max), nil
+}
+
+// KioskFailures counts recent failed sign-ins at a kiosk or from a client.
+type KioskFailures struct {
+	Count int
+	Since time.Time // start of the current window
+}
+
+func kioskFailuresKey(c context.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, "kiosk_failures", id, 0, nil)
+}
+
+func (f KioskFailures) lockedOut(max int, now time.Time) bool {
+	return f.Count >= max && now.Sub(f.Since) < kioskLockoutWindow
+}
+
+func (f *KioskFailures) add(now time.Time) {
+	if now.Sub(f.Since) >= kioskLockoutWindow {
+		*f = KioskFailures{Since: now}
+	}
+	f.Count++
+}
+
+// kioskLimit is a counter of failed sign-ins and how many it allows.
+type kioskLimit struct {
+	id  string
+	max int
+}
+
+func kioskLimits(d Dispenser, r *http.Request) []kioskLimit {
+	return []kioskLimit{
+		{"kiosk|" + strings.ToLower(d.Name), kioskMaxFailuresPerKiosk},
+		{"client|" + r.RemoteAddr, kioskMaxFailuresPerClient},
+	}
+}
+
+// kioskLockedOut returns whether there have been too many failed sign-ins at
+// the kiosk or from the client.
+func kioskLockedOut(c context.Context, limits []kioskLimit, now time.Time) (bool, error) {
+	for _, limit := range limits {
+		var f KioskFailures
+		err := datastore.Get(c, kioskFailuresKey(c, limit.id), &f)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return false, err
+		}
+		if f.lockedOut(limit.max, now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func recordKioskFailure(c context.Context, limits []kioskLimit, now time.Time) error {
+	for _, limit := range limits {
+		key := kioskFailuresKey(c, limit.id)
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			var f KioskFailures
+			if err := datastore.Get(c, key, &f); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			f.add(now)
+			_, err := datastore.Put(c, key, &f)
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return "chompy-" + hex.EncodeToString(b[:]), nil
+}
+
+// signKioskSession returns a session token for email on a kiosk, valid until
+// expires.  It's signed with the kiosk's token so no state is kept.
+func signKioskSession(kioskToken, email string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d|%s", expires.Unix(), email)))
+	h := hmac.New(sha256.New, []byte(kioskToken))
+	h.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(h.Sum(nil))
+}
+
+// checkKioskSession returns the email of a valid, unexpired session.
+func checkKioskSession(kioskToken, session string, now time.Time) (string, bool) {
+	parts := strings.SplitN(session, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	h := hmac.New(sha256.New, []byte(kioskToken))
+	h.Write([]byte(parts[0]))
+	if !hmac.Equal([]byte(parts[1]), []byte(hex.EncodeToString(h.Sum(nil)))) {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	fields := strings.SplitN(string(payload), "|", 2)
+	if len(fields) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || now.After(time.Unix(expires, 0)) {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// kioskDispenser returns the dispenser a kiosk request is for, checking the
+// kiosk's token.
+func kioskDispenser(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) (Dispenser, bool) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return Dispenser{}, false
+	}
+	d, err := cfg.Dispenser(p["name"])
+	if err != nil || d.KioskToken == "" ||
+		!hmac.Equal([]byte(d.KioskToken), []byte(r.FormValue("token"))) {
+		http.NotFound(w, r)
+		return Dispenser{}, false
+	}
+	return d, true
+}
+
+// availableRewards returns the keys of email's available rewards, oldest first.
+func availableRewards(c context.Context, email string) ([]*datastore.Key, error) {
+	var rewards []Reward
+	keys, err := datastore.NewQuery("rewards").
+		Filter("EmailAddress =", email).
+		Order("-Granted").
+		GetAll(c, &rewards)
+	var available []*datastore.Key
+	for i := len(rewards) - 1; i >= 0; i-- {
+		if rewards[i].Available() {
+			available = append(available, keys[i])
+		}
+	}
+	return available, err
+}
+
+type kioskSession struct {
+	Email     string `json:"email"`
+	Session   string `json:"session"`
+	Available int    `json:"available"`
+}
+
+func writeKioskSession(w http.ResponseWriter, c context.Context, d Dispenser, email string) {
+	available, err := availableRewards(c, email)
+	if err != nil {
+		log.Criticalf(c, "Failed to load rewards for %q: %v", email, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(kioskSession{
+		Email:     email,
+		Session:   signKioskSession(d.KioskToken, email, time.Now().Add(kioskSessionLength)),
+		Available: len(available),
+	})
+}
+
+func ShowKiosk(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	d, ok := kioskDispenser(w, r, c, p)
+	if !ok {
+		return
+	}
+	params := struct {
+		Dispenser   Dispenser
+		Token       string
+		IdleTimeout int
+	}{d, r.FormValue("token"), int(kioskIdleTimeout / time.Millisecond)}
+	if err := kioskHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render kiosk template: %v", err)
+	}
+}
+
+// KioskLogin identifies someone at the kiosk by their badge, QR code or PIN.
+// Too many failed attempts lock the kiosk, or the client, out for a while.
+func KioskLogin(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	d, ok := kioskDispenser(w, r, c, p)
+	if !ok {
+		return
+	}
+	credential := strings.TrimSpace(r.FormValue("credential"))
+	if credential == "" {
+		http.Error(w, "Not recognized", http.StatusForbidden)
+		return
+	}
+	limits := kioskLimits(d, r)
+	if locked, err := kioskLockedOut(c, limits, time.Now()); err != nil {
+		log.Criticalf(c, "Failed to check kiosk sign-in failures: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	} else if locked {
+		log.Warningf(c, "Kiosk sign-in at %q from %s locked out", d.Name, r.RemoteAddr)
+		http.Error(w, "Too many failed sign-ins, try again later", http.StatusTooManyRequests)
+		return
+	}
+	var cred KioskCredential
+	if err := datastore.Get(c, kioskCredentialKey(c, credential), &cred); err == datastore.ErrNoSuchEntity {
+		log.Warningf(c, "Unknown kiosk credential at %q from %s", d.Name, r.RemoteAddr)
+		if err := recordKioskFailure(c, limits, time.Now()); err != nil {
+			log.Errorf(c, "Failed to record kiosk sign-in failure: %v", err)
+		}
+		http.Error(w, "Not recognized", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to look up kiosk credential: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q signed in to the %q kiosk with their %s", cred.Email, d.Name, cred.Kind)
+	writeKioskSession(w, c, d, cred.Email)
+}
+
+// KioskDispense dispenses the oldest available reward of whoever is signed in
+// to the kiosk.  No presence code is needed since the kiosk is at the machine.
+func KioskDispense(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	d, ok := kioskDispenser(w, r, c, p)
+	if !ok {
+		return
+	}
+	email, ok := checkKioskSession(d.KioskToken, r.FormValue("session"), time.Now())
+	if !ok {
+		http.Error(w, "Signed out", http.StatusUnauthorized)
+		return
+	}
+	available, err := availableRewards(c, email)
+	if err != nil {
+		countDispense("internal_error")
+		log.Criticalf(c, "Failed to load rewards for %q: %v", email, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if len(available) == 0 {
+		countDispense("unavailable")
+		http.Error(w, "No credits left", http.StatusGone)
+		return
+	}
+	if code, err := dispenseReward(c, available[0], d, email); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeKioskSession(w, c, d, email)
+}
+
+// SetKioskCredential lets people get a new kiosk PIN or QR code, or register
+// their badge.
+func SetKioskCredential(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	kind := r.FormValue("kind")
+	var credential string
+	var err error
+	switch kind {
+	case KioskPin:
+		// Retry on the off chance that the PIN is taken.
+		for i := 0; i < 5; i++ {
+			if credential, err = randomPin(); err == nil {
+				if err = setKioskCredential(c, u.Email, kind, credential); err != errCredentialTaken {
+					break
+				}
+			}
+		}
+	case KioskQR:
+		if credential, err = randomToken(); err == nil {
+			err = setKioskCredential(c, u.Email, kind, credential)
+		}
+	case KioskBadge:
+		credential = strings.TrimSpace(r.FormValue("badge"))
+		if credential == "" {
+			http.Error(w, "No badge given", http.StatusBadRequest)
+			return
+		}
+		err = setKioskCredential(c, u.Email, kind, credential)
+	default:
+		http.Error(w, "Unknown kind of kiosk login", http.StatusBadRequest)
+		return
+	}
+	if err == errCredentialTaken {
+		http.Error(w, fmt.Sprintf("That %s is %v", kind, err), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to set %s kiosk login for %q: %v", kind, u.Email, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q set a new kiosk %s", u.Email, kind)
+
+	params := struct {
+		Kind, Credential string
+	}{kind, credential}
+	if err := kioskCredentialHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render kiosk credential template: %v", err)
+	}
+}
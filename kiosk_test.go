@@ -0,0 +1,64 @@
+package chompy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKioskSession(t *testing.T) {
+	now := time.Now()
+	session := signKioskSession("kiosk-token", "alice@example.com", now.Add(time.Minute))
+
+	if email, ok := checkKioskSession("kiosk-token", session, now); !ok || email != "alice@example.com" {
+		t.Errorf("Valid session rejected: %q %v", email, ok)
+	}
+	if _, ok := checkKioskSession("kiosk-token", session, now.Add(2*time.Minute)); ok {
+		t.Errorf("Expired session accepted")
+	}
+	if _, ok := checkKioskSession("other-kiosk", session, now); ok {
+		t.Errorf("Session from another kiosk accepted")
+	}
+	forged := signKioskSession("kiosk-token", "bob@example.com", now.Add(time.Minute))
+	if _, ok := checkKioskSession("kiosk-token", forged[:len(forged)-1]+"x", now); ok {
+		t.Errorf("Tampered session accepted")
+	}
+	if _, ok := checkKioskSession("kiosk-token", "", now); ok {
+		t.Errorf("Empty session accepted")
+	}
+}
+
+func TestRandomPin(t *testing.T) {
+	pin, err := randomPin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pin) != kioskPinDigits || strings.Trim(pin, "0123456789") != "" {
+		t.Errorf("Bad PIN %q", pin)
+	}
+}
+
+func TestKioskFailures(t *testing.T) {
+	now := time.Now()
+	var f KioskFailures
+	for i := 0; i < kioskMaxFailuresPerClient; i++ {
+		if f.lockedOut(kioskMaxFailuresPerClient, now) {
+			t.Fatalf("Locked out after %d failures", i)
+		}
+		f.add(now.Add(time.Duration(i) * time.Minute))
+	}
+	if !f.lockedOut(kioskMaxFailuresPerClient, now.Add(kioskLockoutWindow-time.Second)) {
+		t.Errorf("Not locked out after %d failures: %+v", f.Count, f)
+	}
+	if f.lockedOut(kioskMaxFailuresPerKiosk, now) {
+		t.Errorf("Kiosk limit shouldn't be reached yet: %+v", f)
+	}
+
+	later := now.Add(kioskLockoutWindow)
+	if f.lockedOut(kioskMaxFailuresPerClient, later) {
+		t.Errorf("Still locked out after the window: %+v", f)
+	}
+	if f.add(later); f.Count != 1 || !f.Since.Equal(later) {
+		t.Errorf("A failure after the window should start a new one: %+v", f)
+	}
+}
@@ -0,0 +1,194 @@
+package chompy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// Everyone gets a monthly allowance of kudos: new thanks credits they can
+// give to other people.  Unused kudos don't roll over to the next month.
+// "Everyone" is only people chompy knows, since anybody can sign in.
+
+// KudosAllowance is how many kudos someone has given in a month.
+type KudosAllowance struct {
+	Email string
+	Month time.Time
+	Given int
+}
+
+// kudosAllowanceName names email's allowance for the month of now.  Each
+// month has its own, which is why unused kudos don't roll over.
+func kudosAllowanceName(email string, now time.Time) string {
+	return fmt.Sprintf("%s|%s", strings.ToLower(email), periodStart(statMonth, now).Format("2006-01"))
+}
+
+func kudosAllowanceKey(c context.Context, email string, now time.Time) *datastore.Key {
+	return datastore.NewKey(c, "kudos_allowances", kudosAllowanceName(email, now), 0, nil)
+}
+
+// remaining returns how many more kudos can be given this month.
+func (a KudosAllowance) remaining(allowance int) int {
+	if remaining := allowance - a.Given; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+var errNoKudosLeft = errors.New("no kudos left this month")
+
+// use takes n kudos from the allowance, or gives them back if n is negative.
+func (a *KudosAllowance) use(n, allowance int) error {
+	if n > 0 && a.Given+n > allowance {
+		return errNoKudosLeft
+	}
+	a.Given += n
+	if a.Given < 0 {
+		a.Given = 0
+	}
+	return nil
+}
+
+// kudosKnown returns whether email is in one of the kudos domains or is
+// configured for github.
+func (cfg Configuration) kudosKnown(email string) bool {
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		for _, domain := range cfg.KudosDomains {
+			if strings.EqualFold(email[at+1:], strings.TrimPrefix(domain, "@")) {
+				return true
+			}
+		}
+	}
+	for _, u := range cfg.GithubUsers {
+		if addr, err := netmail.ParseAddress(cleanEmail(u.Email)); err == nil &&
+			strings.EqualFold(addr.Address, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// kudosEligible returns whether email gets the monthly kudos allowance: they
+// must be known from the configuration or be on a team.  Both are up to
+// admins; having been given credits isn't enough, since kudos to a second
+// account would then let people give themselves kudos.
+func kudosEligible(c context.Context, cfg Configuration, email string) (bool, error) {
+	if cfg.kudosKnown(email) {
+		return true, nil
+	}
+	teams, err := loadTeamsFor(c, email)
+	return len(teams) > 0, err
+}
+
+// kudosRemaining returns how many more kudos email can give this month.
+func kudosRemaining(c context.Context, cfg Configuration, email string) (int, error) {
+	if ok, err := kudosEligible(c, cfg, email); !ok || err != nil {
+		return 0, err
+	}
+	var a KudosAllowance
+	err := datastore.Get(c, kudosAllowanceKey(c, email, time.Now()), &a)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+	return a.remaining(cfg.KudosAllowance), nil
+}
+
+// useKudos takes n kudos from email's allowance for this month, or gives them
+// back if n is negative.
+func useKudos(c context.Context, cfg Configuration, email string, n int) error {
+	now := time.Now()
+	key := kudosAllowanceKey(c, email, now)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		a := KudosAllowance{Email: email, Month: periodStart(statMonth, now)}
+		if err := datastore.Get(c, key, &a); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := a.use(n, cfg.KudosAllowance); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, key, &a)
+		return err
+	}, nil)
+}
+
+// refundKudos returns whether a kudos whose grant failed with code should be
+// given back.  A 500 may have come after the reward was saved, e.g. if the
+// email failed, so it isn't.
+func refundKudos(code int, err error) bool {
+	return err != nil && code != http.StatusInternalServerError
+}
+
+// giveKudos grants a thanks credit from one person to another.  Unless
+// unlimited, it comes out of the giver's monthly allowance.
+func giveKudos(c context.Context, r *http.Request, cfg Configuration, from, to, msg string, unlimited bool) (code int, err error) {
+	if strings.EqualFold(from, to) {
+		log.Warningf(c, "%q may be a narcissist: kudos", from)
+		return http.StatusBadRequest, fmt.Errorf("Kudos to yourself?  Really?")
+	}
+	if !unlimited {
+		if ok, err := kudosEligible(c, cfg, from); err != nil {
+			log.Criticalf(c, "Failed to check whether %q gets kudos: %v", from, err)
+			return http.StatusInternalServerError, fmt.Errorf("Internal error, no kudos given")
+		} else if !ok {
+			log.Warningf(c, "%q isn't known, so has no kudos to give", from)
+			return http.StatusForbidden, fmt.Errorf("Only people on a team or configured on /config can give kudos")
+		}
+		if err := useKudos(c, cfg, from, 1); err == errNoKudosLeft {
+			return http.StatusForbidden, fmt.Errorf("You've given all %d of your kudos this month", cfg.KudosAllowance)
+		} else if err != nil {
+			log.Criticalf(c, "Failed to use kudos of %q: %v", from, err)
+			return http.StatusInternalServerError, fmt.Errorf("Internal error, no kudos given")
+		}
+	}
+
+	desc := fmt.Sprintf("Kudos from %s at %s", from, time.Now().Format(time.RFC3339Nano))
+	if msg != "" {
+		desc = fmt.Sprintf("%s: %s", desc, msg)
+	}
+	code, err = grantReward(c, r, to, "thanks", desc)
+	if !unlimited && refundKudos(code, err) {
+		// Nothing was granted, so don't count it.
+		if err := useKudos(c, cfg, from, -1); err != nil {
+			log.Errorf(c, "Failed to give back kudos to %q: %v", from, err)
+		}
+	}
+	return code, err
+}
+
+func GiveKudos(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	rawemail := strings.Replace(r.FormValue("email"), "(", "<", -1)
+	rawemail = strings.Replace(rawemail, ")", ">", -1)
+	addr, err := netmail.ParseAddress(rawemail)
+	if err != nil {
+		log.Errorf(c, "Bad inputs: email=%q err=%v", rawemail, err)
+		http.Error(w, "Bad inputs", http.StatusBadRequest)
+		return
+	}
+
+	if code, err := giveKudos(c, r, cfg, u.Email, addr.Address, r.FormValue("msg"), cfg.CanMintKudos(u.Email)); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	log.Infof(c, "%q gave kudos to %q", u.Email, addr.Address)
+	fmt.Fprintf(w, "Kudos sent to %s!", addr.Address)
+}
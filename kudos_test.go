@@ -0,0 +1,104 @@
+package chompy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKudosAllowanceName(t *testing.T) {
+	jan31 := time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		email string
+		now   time.Time
+		want  string
+	}{
+		{"alice@example.com", jan31, "alice@example.com|2026-01"},
+		{"Alice@Example.com", jan31, "alice@example.com|2026-01"},
+		{"alice@example.com", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), "alice@example.com|2026-01"},
+		// Unused kudos don't roll over: a new month is a new allowance.
+		{"alice@example.com", jan31.Add(time.Hour), "alice@example.com|2026-02"},
+		{"alice@example.com", time.Date(2026, 12, 31, 12, 0, 0, 0, time.UTC), "alice@example.com|2026-12"},
+	} {
+		if got := kudosAllowanceName(test.email, test.now); got != test.want {
+			t.Errorf("kudosAllowanceName(%q, %v) = %q, want %q", test.email, test.now, got, test.want)
+		}
+	}
+}
+
+func TestKudosAllowanceUse(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		given, n, limit int
+		wantErr         error
+		wantGiven       int
+		wantRemaining   int
+	}{
+		{"first of the month", 0, 1, 3, nil, 1, 2},
+		{"last one", 2, 1, 3, nil, 3, 0},
+		{"over the limit", 3, 1, 3, errNoKudosLeft, 3, 0},
+		{"no allowance", 0, 1, 0, errNoKudosLeft, 0, 0},
+		{"allowance lowered", 5, 1, 3, errNoKudosLeft, 5, 0},
+		{"refund", 3, -1, 3, nil, 2, 1},
+		{"refund when over the limit", 5, -1, 3, nil, 4, 0},
+		{"refund of nothing", 0, -1, 3, nil, 0, 3},
+	} {
+		a := KudosAllowance{Given: test.given}
+		if err := a.use(test.n, test.limit); err != test.wantErr {
+			t.Errorf("%s: use(%d) error %v, want %v", test.name, test.n, err, test.wantErr)
+		}
+		if a.Given != test.wantGiven {
+			t.Errorf("%s: given %d, want %d", test.name, a.Given, test.wantGiven)
+		}
+		if got := a.remaining(test.limit); got != test.wantRemaining {
+			t.Errorf("%s: remaining %d, want %d", test.name, got, test.wantRemaining)
+		}
+	}
+}
+
+func TestKudosKnown(t *testing.T) {
+	cfg := Configuration{
+		KudosDomains: []string{"example.com", "@corp.example.org"},
+		GithubUsers: []GithubUserInfo{
+			{Username: "carol", Email: "Carol (carol@contractor.net)"},
+			{Username: "dave", Email: "dave@other.net"},
+		},
+	}
+	for _, test := range []struct {
+		email string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"alice@EXAMPLE.com", true},
+		{"bob@corp.example.org", true},
+		{"mallory@example.com.evil.net", false},
+		{"mallory@notexample.com", false},
+		{"carol@contractor.net", true},
+		{"Dave@Other.net", true},
+		{"eve@gmail.com", false},
+		{"example.com", false},
+	} {
+		if got := cfg.kudosKnown(test.email); got != test.want {
+			t.Errorf("kudosKnown(%q) = %v, want %v", test.email, got, test.want)
+		}
+	}
+}
+
+func TestRefundKudos(t *testing.T) {
+	failed := errors.New("failed")
+	for _, test := range []struct {
+		code int
+		err  error
+		want bool
+	}{
+		{http.StatusOK, nil, false},
+		{http.StatusBadRequest, failed, true}, // e.g. bad recipient
+		{http.StatusConflict, failed, true},
+		{http.StatusInternalServerError, failed, false}, // may have been granted
+	} {
+		if got := refundKudos(test.code, test.err); got != test.want {
+			t.Errorf("refundKudos(%d, %v) = %v, want %v", test.code, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package chompy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/augustoroman/chompy/snackbot"
+)
+
+// Prometheus metrics, served on /metrics.  Counters are per-instance, so if
+// more than one instance is running each scrape only sees the instance that
+// happened to serve it; use rate()/increase() rather than raw values.
+var (
+	metricGrants = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chompy",
+		Name:      "grants_total",
+		Help:      "Rewards granted, by reward type and how they were granted.",
+	}, []string{"type", "source"})
+
+	metricDispenses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chompy",
+		Name:      "dispenses_total",
+		Help:      "Attempts to dispense a reward, by outcome and failure reason.",
+	}, []string{"outcome", "reason"})
+
+	metricDonations = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "chompy",
+		Name:      "donated_credits_total",
+		Help:      "Credits donated from one user to another.",
+	})
+
+	metricWebhooks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chompy",
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries, by provider, event and outcome.",
+	}, []string{"provider", "event", "outcome"})
+
+	metricAgentLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chompy",
+		Name:      "agent_request_duration_seconds",
+		Help:      "Latency of requests to the snackbot agent, by endpoint and outcome.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"endpoint", "outcome"})
+
+	metricUnusedCredits = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chompy",
+		Name:      "unused_credits",
+		Help:      "Credits that have been granted but not yet dispensed or revoked.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricGrants, metricDispenses, metricDonations,
+		metricWebhooks, metricAgentLatency, metricUnusedCredits)
+}
+
+// grantSource describes where a grant request came from for metrics.
+func grantSource(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.Header.Get("User-Agent"), "GitHub-Hookshot/"):
+		return "github"
+	case r.URL.Path == "/webhook":
+		return "webhook"
+	case r.URL.Path == "/slack":
+		return "slack"
+	case strings.HasPrefix(r.URL.Path, "/ci/"):
+		return "ci"
+	case r.URL.Path == "/backfill":
+		return "backfill"
+	}
+	return "api"
+}
+
+func countDispense(reason string) {
+	if reason == "" {
+		metricDispenses.WithLabelValues("success", "").Inc()
+	} else {
+		metricDispenses.WithLabelValues("failure", reason).Inc()
+	}
+}
+
+func observeAgentRequest(endpoint string, elapsed time.Duration, err error) {
+	outcome := "ok"
+	if e, ok := err.(*snackbot.Error); ok {
+		outcome = e.Kind.String()
+	} else if err != nil {
+		outcome = "error"
+	}
+	metricAgentLatency.WithLabelValues(endpoint, outcome).Observe(elapsed.Seconds())
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Outcome() string {
+	switch {
+	case s.status < 300:
+		return "ok"
+	case s.status < 500:
+		return "rejected"
+	}
+	return "error"
+}
+
+func countUnusedCredits(c context.Context) (int, error) {
+	// Only available rewards can be revoked, so revoked rewards all still
+	// have a zero Dispensed time.
+	undispensed, err := datastore.NewQuery("rewards").
+		Filter("Dispensed =", time.Time{}).
+		KeysOnly().
+		Count(c)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := datastore.NewQuery("rewards").
+		Filter("Revoked >", time.Time{}).
+		KeysOnly().
+		Count(c)
+	if err != nil {
+		return 0, err
+	}
+	return undispensed - revoked, nil
+}
+
+// Github events counted by name in metricWebhooks.  The event header isn't
+// authenticated, so anything else counts as "other" to keep the number of
+// time series bounded.
+var metricGithubEvents = []string{
+	"ping", "pull_request", "pull_request_review", "pull_request_review_comment", "workflow_run",
+}
+
+func githubEventLabel(event string) string {
+	for _, e := range metricGithubEvents {
+		if event == e {
+			return event
+		}
+	}
+	return "other"
+}
+
+func ServeMetrics(w http.ResponseWriter, r *http.Request, c context.Context) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || !cfg.validAuth(strings.TrimPrefix(auth, "Bearer ")) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if n, err := countUnusedCredits(c); err != nil {
+		log.Errorf(c, "Failed to count unused credits: %v", err)
+	} else {
+		metricUnusedCredits.Set(float64(n))
+	}
+	promhttp.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,19 @@
+package chompy
+
+import "testing"
+
+func TestGithubEventLabel(t *testing.T) {
+	for event, want := range map[string]string{
+		"pull_request":  "pull_request",
+		"workflow_run":  "workflow_run",
+		"ping":          "ping",
+		"issues":        "other",
+		"":              "other",
+		"made-up-12345": "other",
+		"Pull_Request":  "other",
+	} {
+		if got := githubEventLabel(event); got != want {
+			t.Errorf("githubEventLabel(%q) = %q, want %q", event, got, want)
+		}
+	}
+}
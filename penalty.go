@@ -0,0 +1,279 @@
+package chompy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// A Penalty is a debt for something like breaking the build.  Instead of
+// being granted, the next credit the person earns pays it off.
+type Penalty struct {
+	Email       string
+	Type        string // one of the Penalty* types
+	Description string // e.g. the url of the broken build
+
+	Status     string // outstanding, paid or forgiven
+	Created    time.Time
+	Resolved   time.Time
+	ResolvedBy string // who forgave it
+	PaidWith   Uid
+}
+
+// Things that can be penalized, if enabled on /config.
+const (
+	PenaltyBuildBroke = "build-broke"
+	PenaltyReverted   = "pr-reverted"
+)
+
+const (
+	PenaltyOutstanding = "outstanding"
+	PenaltyPaid        = "paid"
+	PenaltyForgiven    = "forgiven"
+)
+
+func (p Penalty) Reason() string {
+	switch p.Type {
+	case PenaltyBuildBroke:
+		return fmt.Sprintf("Broke the build: %s", p.Description)
+	case PenaltyReverted:
+		return fmt.Sprintf("Pull request was reverted: %s", p.Description)
+	}
+	return p.Description
+}
+
+// PenaltyId identifies a penalty by what it's for, so that the same thing is
+// only ever penalized once, e.g. if a webhook is redelivered.
+type PenaltyId string
+
+func penaltyId(typ, email, desc string) PenaltyId {
+	hash := sha1.Sum([]byte(typ + "|" + email + "|" + desc))
+	return PenaltyId(hex.EncodeToString(hash[:]))
+}
+
+func (id PenaltyId) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "penalties", string(id), 0, nil)
+}
+
+// PenaltyEntry pairs a penalty with its id for rendering.
+type PenaltyEntry struct {
+	Id PenaltyId
+	Penalty
+}
+
+func (cfg Configuration) PenaltyEnabled(typ string) bool {
+	for _, t := range cfg.Penalties {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// newPenalty returns an outstanding penalty and its id.  Its email is
+// canonical, since penalties are looked up by the address people sign in or
+// earn credits with, whatever form it was given in.
+func newPenalty(email, typ, desc string, now time.Time) (PenaltyId, *Penalty) {
+	email = canonicalEmail(email)
+	return penaltyId(typ, email, desc), &Penalty{
+		Email:       email,
+		Type:        typ,
+		Description: desc,
+		Status:      PenaltyOutstanding,
+		Created:     now,
+	}
+}
+
+// addPenalty gives email a penalty, if that kind of penalty is enabled.
+func addPenalty(c context.Context, cfg Configuration, email, typ, desc string) error {
+	if !cfg.PenaltyEnabled(typ) {
+		return nil
+	}
+	id, p := newPenalty(email, typ, desc, time.Now())
+	key := id.Key(c)
+	added := false
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		added = false
+		if err := datastore.Get(c, key, &Penalty{}); err != datastore.ErrNoSuchEntity {
+			return err // Already penalized, or failed.
+		}
+		added = true
+		_, err := datastore.Put(c, key, p)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if added {
+		log.Warningf(c, "Penalized %q: %s", p.Email, p.Reason())
+	} else {
+		log.Infof(c, "%q was already penalized: %s", p.Email, p.Reason())
+	}
+	return nil
+}
+
+func outstandingPenalties(c context.Context, email string) ([]PenaltyEntry, error) {
+	var penalties []Penalty
+	keys, err := datastore.NewQuery("penalties").
+		Filter("Email =", canonicalEmail(email)).
+		Filter("Status =", PenaltyOutstanding).
+		Order("Created").
+		GetAll(c, &penalties)
+	var entries []PenaltyEntry
+	for i, key := range keys {
+		entries = append(entries, PenaltyEntry{PenaltyId(key.StringID()), penalties[i]})
+	}
+	return entries, err
+}
+
+// payPenalty uses a newly earned reward to pay off the oldest outstanding
+// penalty, if there is one.  It returns whether it did; if so the reward has
+// been saved as used.
+func payPenalty(c context.Context, reward *Reward) (bool, error) {
+	penalties, err := outstandingPenalties(c, reward.EmailAddress)
+	if err != nil || len(penalties) == 0 {
+		return false, err
+	}
+	id := penalties[0].Id
+	paid := false
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var p Penalty
+		if err := datastore.Get(c, id.Key(c), &p); err != nil {
+			return err
+		}
+		if p.Status != PenaltyOutstanding {
+			return nil // Forgiven in the meantime.
+		}
+		p.Status, p.Resolved, p.PaidWith = PenaltyPaid, time.Now(), reward.Uid()
+		if _, err := datastore.Put(c, id.Key(c), &p); err != nil {
+			return err
+		}
+		reward.PayPenalty(p.Reason())
+		if _, err := datastore.Put(c, reward.Uid().Key(c), reward); err != nil {
+			return err
+		}
+		paid = true
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	return paid, err
+}
+
+func sendPenaltyPaidEmail(c context.Context, r *http.Request, reward Reward) error {
+	return mail.Send(c, &mail.Message{
+		Sender:  fmt.Sprintf("Chompy <notify@%s.appspotmail.com>", appengine.AppID(c)),
+		To:      []string{reward.EmailAddress},
+		Subject: "Your candy paid off a penalty",
+		Body: fmt.Sprintf("You earned a credit (%s), but it went to paying off a penalty.\n\n"+
+			"See your credits and penalties: http://%s/me",
+			reward.Reason(), r.Host),
+	})
+}
+
+// Reverts created by github's "Revert" button say which pull request they
+// revert in their body.
+var revertRegexp = regexp.MustCompile(`(?m)^Reverts ([\w.-]+/[\w.-]+)#(\d+)`)
+
+// revertedPullRequest returns the url of the pull request reverted by a pull
+// request with the given body, or "".
+func revertedPullRequest(body string) string {
+	m := revertRegexp.FindStringSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return fmt.Sprintf("https://github.com/%s/pull/%s", m[1], m[2])
+}
+
+// penalizeRevert penalizes whoever was credited for a pull request that was
+// reverted.
+func penalizeRevert(c context.Context, cfg Configuration, prUrl string) error {
+	if !cfg.PenaltyEnabled(PenaltyReverted) {
+		return nil
+	}
+	var rewards []Reward
+	_, err := datastore.NewQuery("rewards").
+		Filter("Type =", "pull-request-merged").
+		Filter("Description =", prUrl).
+		Limit(1).
+		GetAll(c, &rewards)
+	if err != nil {
+		return err
+	}
+	if len(rewards) == 0 {
+		log.Infof(c, "Nobody was credited for reverted %s", prUrl)
+		return nil
+	}
+	// Penalize whoever earned it, not whoever it was donated to.
+	return addPenalty(c, cfg, rewards[0].Email, PenaltyReverted, prUrl)
+}
+
+// ShowPenalties lists recent penalties for admins to forgive.
+func ShowPenalties(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	var penalties []Penalty
+	keys, err := datastore.NewQuery("penalties").
+		Order("-Created").
+		Limit(200).
+		GetAll(c, &penalties)
+	if err != nil {
+		log.Criticalf(c, "Failed to load penalties: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	var entries []PenaltyEntry
+	for i, key := range keys {
+		entries = append(entries, PenaltyEntry{PenaltyId(key.StringID()), penalties[i]})
+	}
+	if err := penaltiesHtmlTpl.Execute(w, entries); err != nil {
+		log.Criticalf(c, "Failed to render penalties template: %v", err)
+	}
+}
+
+func ForgivePenalty(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	id := PenaltyId(p["id"])
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var penalty Penalty
+		if err := datastore.Get(c, id.Key(c), &penalty); err != nil {
+			return err
+		}
+		if penalty.Status != PenaltyOutstanding {
+			return errNotAvailable
+		}
+		penalty.Status, penalty.Resolved, penalty.ResolvedBy = PenaltyForgiven, time.Now(), u.Email
+		_, err := datastore.Put(c, id.Key(c), &penalty)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err == errNotAvailable {
+		http.Error(w, "Penalty isn't outstanding", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to forgive penalty %s: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q forgave penalty %s", u.Email, id)
+	http.Redirect(w, r, "/penalties", http.StatusSeeOther)
+}
@@ -0,0 +1,50 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevertedPullRequest(t *testing.T) {
+	tests := []struct{ body, want string }{
+		{"Reverts augustoroman/chompy#42", "https://github.com/augustoroman/chompy/pull/42"},
+		{"Broke the build.\r\nReverts augustoroman/chompy#7\r\n", "https://github.com/augustoroman/chompy/pull/7"},
+		{"This reverts augustoroman/chompy#42", ""},
+		{"Reverts #42", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := revertedPullRequest(test.body); got != test.want {
+			t.Errorf("revertedPullRequest(%q) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestPenaltyId(t *testing.T) {
+	id := penaltyId(PenaltyReverted, "a@b.com", "https://github.com/augustoroman/chompy/pull/42")
+	if again := penaltyId(PenaltyReverted, "a@b.com", "https://github.com/augustoroman/chompy/pull/42"); again != id {
+		t.Errorf("Same penalty got different ids: %q and %q", id, again)
+	}
+	if other := penaltyId(PenaltyBuildBroke, "a@b.com", "https://github.com/augustoroman/chompy/pull/42"); other == id {
+		t.Errorf("Different penalties got the same id %q", id)
+	}
+}
+
+func TestNewPenalty(t *testing.T) {
+	now := time.Now()
+	id, p := newPenalty("alice@example.com", PenaltyBuildBroke, "https://ci.example.com/1", now)
+	for _, email := range []string{
+		"Alice <alice@example.com>",
+		"Alice (Alice@Example.com)",
+		"ALICE@example.com",
+		" alice@example.com ",
+	} {
+		otherId, other := newPenalty(email, PenaltyBuildBroke, "https://ci.example.com/1", now)
+		if other.Email != "alice@example.com" || otherId != id {
+			t.Errorf("Penalty for %q: %q %s, want %q %s", email, other.Email, otherId, p.Email, id)
+		}
+	}
+	if p.Status != PenaltyOutstanding || !p.Created.Equal(now) {
+		t.Errorf("Wrong new penalty: %+v", p)
+	}
+}
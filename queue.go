@@ -0,0 +1,322 @@
+package chompy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// QueuedDispense is a reward waiting for an offline dispenser to come back.
+// The reward is reserved while it waits.  When the status poller sees the
+// dispenser online the owner is emailed, and it's dispensed once they confirm
+// that they're at the machine.
+type QueuedDispense struct {
+	Reward    Uid
+	Email     string // who queued it and has to confirm
+	Dispenser string
+	Status    string // one of the Queue* constants
+	Queued    time.Time
+	Ready     time.Time // when the dispenser came back online
+	Resolved  time.Time
+}
+
+const (
+	QueueWaiting   = "waiting" // for the dispenser to come back online
+	QueueReady     = "ready"   // for the owner to confirm
+	QueueDispensed = "dispensed"
+	QueueFailed    = "failed"
+	QueueExpired   = "expired"
+	QueueCanceled  = "canceled"
+)
+
+const (
+	// How long a dispense may wait for its dispenser to come back online.
+	queueWaitExpiry = 24 * time.Hour
+	// How long the owner has to confirm once the dispenser is back.
+	queueReadyExpiry = time.Hour
+)
+
+func (q QueuedDispense) Pending() bool {
+	return q.Status == QueueWaiting || q.Status == QueueReady
+}
+
+// Expires returns when the queued dispense will be given up on.
+func (q QueuedDispense) Expires() time.Time {
+	if q.Status == QueueReady {
+		return q.Ready.Add(queueReadyExpiry)
+	}
+	return q.Queued.Add(queueWaitExpiry)
+}
+
+type QueuedDispenseId int64
+
+func (id QueuedDispenseId) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "dispense_queue", "", int64(id), nil)
+}
+
+// PendingDispense pairs a queued dispense with its id for rendering.
+type PendingDispense struct {
+	Id QueuedDispenseId
+	QueuedDispense
+}
+
+func pendingDispensesFor(c context.Context, email string) ([]PendingDispense, error) {
+	var queued []QueuedDispense
+	keys, err := datastore.NewQuery("dispense_queue").
+		Filter("Email =", email).
+		Filter("Resolved =", time.Time{}).
+		GetAll(c, &queued)
+	var pending []PendingDispense
+	for i, key := range keys {
+		pending = append(pending, PendingDispense{QueuedDispenseId(key.IntID()), queued[i]})
+	}
+	return pending, err
+}
+
+var errNotQueued = errors.New("not queued")
+
+// queueDispense reserves a reward until d is back online.
+func queueDispense(c context.Context, reward Reward, d Dispenser, actor string) (QueuedDispenseId, error) {
+	key := reward.Uid().Key(c)
+	q := QueuedDispense{
+		Reward:    reward.Uid(),
+		Email:     actor,
+		Dispenser: d.Name,
+		Status:    QueueWaiting,
+		Queued:    time.Now(),
+	}
+	qkey := datastore.NewIncompleteKey(c, "dispense_queue", nil)
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		var reward Reward
+		if err := datastore.Get(c, key, &reward); err != nil {
+			return err
+		}
+		if !reward.Available() {
+			return errNotAvailable
+		}
+		reward.Queue(actor, fmt.Sprintf("Waiting for %s", d.Name))
+		if _, err := datastore.Put(c, key, &reward); err != nil {
+			return err
+		}
+		var err error
+		qkey, err = datastore.Put(c, qkey, &q)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return QueuedDispenseId(qkey.IntID()), err
+}
+
+// resolveQueuedDispense closes a queued dispense and takes its reward out of
+// the queue, refunding it with refundMsg unless it's about to be dispensed.
+func resolveQueuedDispense(c context.Context, id QueuedDispenseId, status, refundMsg string) (QueuedDispense, error) {
+	var q QueuedDispense
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, id.Key(c), &q); err != nil {
+			return err
+		}
+		if !q.Pending() {
+			return errNotQueued
+		}
+		q.Status = status
+		q.Resolved = time.Now()
+		if _, err := datastore.Put(c, id.Key(c), &q); err != nil {
+			return err
+		}
+
+		var reward Reward
+		if err := datastore.Get(c, q.Reward.Key(c), &reward); err != nil {
+			return err
+		}
+		reward.Dequeue(refundMsg)
+		_, err := datastore.Put(c, q.Reward.Key(c), &reward)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return q, err
+}
+
+// processDispenseQueue tells the owners of dispenses waiting on d, which is
+// now online, to come and get their candy.
+func processDispenseQueue(c context.Context, d Dispenser, host string) error {
+	var waiting []QueuedDispense
+	keys, err := datastore.NewQuery("dispense_queue").
+		Filter("Dispenser =", d.Name).
+		Filter("Status =", QueueWaiting).
+		GetAll(c, &waiting)
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		var q QueuedDispense
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			if err := datastore.Get(c, key, &q); err != nil {
+				return err
+			}
+			if q.Status != QueueWaiting {
+				return errNotQueued
+			}
+			q.Status = QueueReady
+			q.Ready = time.Now()
+			_, err := datastore.Put(c, key, &q)
+			return err
+		}, nil)
+		if err == errNotQueued {
+			continue
+		} else if err != nil {
+			return err
+		}
+		log.Infof(c, "Queued dispense %d of %s for %s is ready", key.IntID(), waiting[i].Reward, q.Email)
+		if err := sendQueueEmail(c, host, QueuedDispenseId(key.IntID()), q, d); err != nil {
+			log.Errorf(c, "Failed to tell %s their dispense is ready: %v", q.Email, err)
+		}
+	}
+	return nil
+}
+
+func sendQueueEmail(c context.Context, host string, id QueuedDispenseId, q QueuedDispense, d Dispenser) error {
+	data := map[string]interface{}{
+		"dispenser": d.Name,
+		"location":  d.Location,
+		"queue_url": fmt.Sprintf("http://%s/me", host),
+		"expires":   q.Expires().Format(time.Kitchen),
+	}
+	return mail.Send(c, &mail.Message{
+		Sender:  fmt.Sprintf("Chompy <notify@%s.appspotmail.com>", appengine.AppID(c)),
+		To:      []string{q.Email},
+		Subject: fmt.Sprintf("%s is back online", d.Name),
+		Body:    renderTemplateOrDie(queueEmailTextTpl, data),
+	})
+}
+
+// expireDispenseQueue refunds dispenses that have been waiting too long.
+func expireDispenseQueue(c context.Context) error {
+	now := time.Now()
+	for _, stale := range []struct {
+		status, field string
+		cutoff        time.Time
+	}{
+		{QueueWaiting, "Queued", now.Add(-queueWaitExpiry)},
+		{QueueReady, "Ready", now.Add(-queueReadyExpiry)},
+	} {
+		keys, err := datastore.NewQuery("dispense_queue").
+			Filter("Status =", stale.status).
+			Filter(stale.field+" <", stale.cutoff).
+			KeysOnly().
+			GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			id := QueuedDispenseId(key.IntID())
+			_, err := resolveQueuedDispense(c, id, QueueExpired, "Queued dispense expired")
+			if err == errNotQueued {
+				continue
+			} else if err != nil {
+				return err
+			}
+			log.Infof(c, "Expired queued dispense %d", id)
+		}
+	}
+	return nil
+}
+
+func loadQueuedDispenseParam(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) (QueuedDispenseId, QueuedDispense, bool) {
+	u := user.Current(c)
+	if u == nil {
+		http.NotFound(w, r)
+		return 0, QueuedDispense{}, false
+	}
+	n, err := strconv.ParseInt(p["id"], 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return 0, QueuedDispense{}, false
+	}
+	id := QueuedDispenseId(n)
+	var q QueuedDispense
+	if err := datastore.Get(c, id.Key(c), &q); err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return 0, q, false
+	} else if err != nil {
+		log.Criticalf(c, "Failed to load queued dispense %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return 0, q, false
+	}
+	if q.Email != u.Email && !u.Admin {
+		http.NotFound(w, r)
+		return 0, q, false
+	}
+	return id, q, true
+}
+
+// ConfirmQueuedDispense dispenses a queued reward once its owner is at the
+// dispenser.
+func ConfirmQueuedDispense(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	id, q, ok := loadQueuedDispenseParam(w, r, c, p)
+	if !ok {
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+	d, err := cfg.Dispenser(q.Dispenser)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status, err := d.Snackbot().Status(c); err != nil || !status.Online {
+		http.Error(w, fmt.Sprintf("%s is still offline", d.Name), http.StatusServiceUnavailable)
+		return
+	}
+	if !checkPresence(w, r, d) {
+		return
+	}
+
+	// Use the resolved copy from here on, so that it stays resolved.
+	q, err = resolveQueuedDispense(c, id, QueueDispensed, "")
+	if err == errNotQueued {
+		http.Error(w, "Not queued", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to dequeue %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if code, err := dispenseReward(c, q.Reward.Key(c), d, q.Email); err != nil {
+		q.Status = QueueFailed
+		if _, err := datastore.Put(c, id.Key(c), &q); err != nil {
+			log.Errorf(c, "Failed to mark queued dispense %d failed: %v", id, err)
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// CancelQueuedDispense gives a queued reward back to its owner.
+func CancelQueuedDispense(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	id, _, ok := loadQueuedDispenseParam(w, r, c, p)
+	if !ok {
+		return
+	}
+	if _, err := resolveQueuedDispense(c, id, QueueCanceled, "Queued dispense canceled"); err == errNotQueued {
+		http.Error(w, "Not queued", http.StatusGone)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to cancel queued dispense %d: %v", id, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
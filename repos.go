@@ -0,0 +1,115 @@
+package chompy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Reward types that github webhooks grant.
+var githubRewardTypes = []string{"pull-request-merged", "pull-request-reviewed", "build-fixed"}
+
+// GithubRepo overrides how webhooks from a repository, or from all of an
+// org's repositories, are handled.  Lists are comma separated strings since
+// the datastore can't store a slice of structs holding slices.
+type GithubRepo struct {
+	Name     string // "owner/name", or "owner" for the whole org
+	Secret   string // webhook secret to use instead of SecretAuthToken
+	Events   string // reward types earned (see githubRewardTypes); empty for all
+	Credits  int    // credits per reward, 0 for 1
+	Branches string // base branches that count; empty for all
+}
+
+func (repo GithubRepo) events() []string   { return splitList(repo.Events) }
+func (repo GithubRepo) branches() []string { return splitList(repo.Branches) }
+
+func (repo GithubRepo) validate() error {
+	if repo.Name == "" || strings.Count(repo.Name, "/") > 1 {
+		return fmt.Errorf("Bad github repository or org name: %q", repo.Name)
+	}
+	if repo.Credits < 0 || repo.Credits > 10 {
+		return fmt.Errorf("Credits for %q are unreasonable: %d", repo.Name, repo.Credits)
+	}
+events:
+	for _, ev := range repo.events() {
+		for _, typ := range githubRewardTypes {
+			if ev == typ {
+				continue events
+			}
+		}
+		return fmt.Errorf("Unknown event for %q: %q (should be one of %s)",
+			repo.Name, ev, strings.Join(githubRewardTypes, ", "))
+	}
+	return nil
+}
+
+// githubRepo returns the settings for a repository ("owner/name"): its own if
+// configured, otherwise its org's, otherwise the defaults.
+func (cfg Configuration) githubRepo(fullName string) GithubRepo {
+	org := strings.SplitN(fullName, "/", 2)[0]
+	var orgRepo *GithubRepo
+	for i, repo := range cfg.GithubRepos {
+		if strings.EqualFold(repo.Name, fullName) {
+			return repo
+		}
+		if org != "" && strings.EqualFold(repo.Name, org) {
+			orgRepo = &cfg.GithubRepos[i]
+		}
+	}
+	if orgRepo != nil {
+		return *orgRepo
+	}
+	return GithubRepo{}
+}
+
+// githubRepoName returns the repository a github webhook payload is about.
+func githubRepoName(body []byte) string {
+	var payload struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		}
+	}
+	json.Unmarshal(body, &payload)
+	return payload.Repository.FullName
+}
+
+func (repo GithubRepo) secret(defaultSecret string) string {
+	if repo.Secret != "" {
+		return repo.Secret
+	}
+	return defaultSecret
+}
+
+// rewards returns whether typ is rewarded for this repository.
+func (repo GithubRepo) rewards(typ string) bool {
+	events := repo.events()
+	if len(events) == 0 {
+		return true
+	}
+	for _, ev := range events {
+		if ev == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (repo GithubRepo) branchAllowed(branch string) bool {
+	branches := repo.branches()
+	if len(branches) == 0 {
+		return true
+	}
+	for _, b := range branches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+func (repo GithubRepo) credits() int {
+	if repo.Credits <= 0 {
+		return 1
+	}
+	return repo.Credits
+}
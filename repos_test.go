@@ -0,0 +1,62 @@
+package chompy
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGithubRepo(t *testing.T) {
+	cfg := Configuration{GithubRepos: []GithubRepo{
+		{Name: "acme", Secret: "org-secret", Events: "pull-request-merged"},
+		{Name: "acme/monorepo", Credits: 2, Branches: "main, release"},
+	}}
+
+	if repo := cfg.githubRepo("acme/monorepo"); repo.Name != "acme/monorepo" ||
+		repo.secret("default") != "default" || repo.credits() != 2 ||
+		!repo.rewards("pull-request-reviewed") || repo.branchAllowed("dev") || !repo.branchAllowed("main") {
+		t.Errorf("Wrong settings for the monorepo: %#v", repo)
+	}
+	if repo := cfg.githubRepo("ACME/toy"); repo.Name != "acme" ||
+		repo.secret("default") != "org-secret" || repo.credits() != 1 ||
+		repo.rewards("pull-request-reviewed") || !repo.rewards("pull-request-merged") || !repo.branchAllowed("dev") {
+		t.Errorf("Wrong settings for an org repo: %#v", repo)
+	}
+	if repo := cfg.githubRepo("other/thing"); repo.Name != "" || repo.secret("default") != "default" {
+		t.Errorf("Wrong settings for another repo: %#v", repo)
+	}
+
+	if name := githubRepoName([]byte(`{"repository":{"full_name":"acme/toy"}}`)); name != "acme/toy" {
+		t.Errorf("githubRepoName = %q", name)
+	}
+	if err := (GithubRepo{Name: "acme", Events: "pull-request-merged, issue-closed"}).validate(); err == nil {
+		t.Errorf("Unknown event wasn't rejected")
+	}
+}
+
+func TestConfigurationDatastoreRoundTrip(t *testing.T) {
+	cfg := Configuration{
+		GithubUsers: []GithubUserInfo{{Username: "alice", Email: "alice@example.com"}},
+		GithubRepos: []GithubRepo{
+			{Name: "acme", Secret: "org-secret", Events: "pull-request-merged, build-fixed"},
+			{Name: "acme/monorepo", Credits: 2, Branches: "main"},
+		},
+		Dispensers:  []Dispenser{{Name: "snackman", AgentURL: "https://agent.example.com/abc"}},
+		KudosGivers: []string{"boss@example.com"},
+	}
+	props, err := datastore.SaveStruct(&cfg)
+	if err != nil {
+		t.Fatalf("Can't save configuration: %v", err)
+	}
+	var loaded Configuration
+	if err := datastore.LoadStruct(&loaded, props); err != nil {
+		t.Fatalf("Can't load configuration: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.GithubRepos, cfg.GithubRepos) {
+		t.Errorf("Repositories changed: %#v", loaded.GithubRepos)
+	}
+	if !reflect.DeepEqual(loaded.Dispensers, cfg.Dispensers) || !reflect.DeepEqual(loaded.GithubUsers, cfg.GithubUsers) {
+		t.Errorf("Configuration changed: %#v", loaded)
+	}
+}
@@ -0,0 +1,141 @@
+package chompy
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// A ReviewRecord tracks someone's reviews of a pull request.  Reviewers are
+// only credited once the pull request is merged, and then only once no matter
+// how many times they approved it.
+type ReviewRecord struct {
+	PullRequest string // html url
+	Reviewer    string // github login
+	Approved    bool
+	Comments    int     // review comments, counting a review's own text as one
+	Counted     []int64 `datastore:",noindex"` // ids of the reviews and comments counted
+	Updated     time.Time
+	Credited    time.Time
+}
+
+func reviewKey(c context.Context, prUrl, reviewer string) *datastore.Key {
+	return datastore.NewKey(c, "pr_reviews", strings.ToLower(reviewer)+"|"+prUrl, 0, nil)
+}
+
+// countComment counts a review or review comment once, however many times
+// its webhook is delivered.
+func (rev *ReviewRecord) countComment(id int64) {
+	for _, counted := range rev.Counted {
+		if counted == id {
+			return
+		}
+	}
+	rev.Counted = append(rev.Counted, id)
+	rev.Comments++
+}
+
+// updateReview applies fn to the record of reviewer's reviews of prUrl.
+func updateReview(c context.Context, prUrl, reviewer string, fn func(*ReviewRecord)) error {
+	key := reviewKey(c, prUrl, reviewer)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		var rev ReviewRecord
+		if err := datastore.Get(c, key, &rev); err == datastore.ErrNoSuchEntity {
+			rev = ReviewRecord{PullRequest: prUrl, Reviewer: reviewer}
+		} else if err != nil {
+			return err
+		}
+		fn(&rev)
+		rev.Updated = time.Now()
+		_, err := datastore.Put(c, key, &rev)
+		return err
+	}, nil)
+}
+
+// reviewCredited decides whether a review of a merged pull request that
+// changed the given number of lines earns a credit.  sameTeam is whether the
+// reviewer and the author share a team.  If not, it says why.
+func (cfg Configuration) reviewCredited(rev ReviewRecord, lines int, sameTeam bool) (bool, string) {
+	switch {
+	case !rev.Approved:
+		return false, "didn't approve it"
+	case !rev.Credited.IsZero():
+		return false, "already credited"
+	case rev.Comments < cfg.ReviewMinComments:
+		return false, fmt.Sprintf("only %d of %d review comments", rev.Comments, cfg.ReviewMinComments)
+	case sameTeam && lines < cfg.ReviewTrivialLines:
+		return false, fmt.Sprintf("trivial (%d lines) pull request by their own team", lines)
+	}
+	return true, ""
+}
+
+// shareTeam reports whether two (parsed) email addresses are on a team
+// together.
+func shareTeam(c context.Context, a, b string) (bool, error) {
+	teams, err := loadTeamsFor(c, a)
+	for _, t := range teams {
+		if t.HasMember(b) {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+// githubEmail returns the parsed email address of a github user, or "".
+func (g *GithubWebhookRequest) githubEmail(username string) string {
+	user := g.LookGithubUser(username)
+	if user == nil {
+		return ""
+	}
+	addr, err := netmail.ParseAddress(user.Email)
+	if err != nil {
+		return user.Email
+	}
+	return addr.Address
+}
+
+// creditReviews grants credits to the reviewers of a pull request that was
+// just merged.  Problems are logged rather than failing the webhook, since
+// the author still deserves their credit.
+func (g *GithubWebhookRequest) creditReviews(prUrl, author string, lines int) {
+	if !g.Repo.rewards("pull-request-reviewed") {
+		return
+	}
+	var reviews []ReviewRecord
+	keys, err := datastore.NewQuery("pr_reviews").Filter("PullRequest =", prUrl).GetAll(g.c, &reviews)
+	if err != nil {
+		log.Criticalf(g.c, "Failed to load reviews of %s: %v", prUrl, err)
+		return
+	}
+	authorEmail := g.githubEmail(author)
+	for i, rev := range reviews {
+		user := g.LookGithubUser(rev.Reviewer)
+		if user == nil {
+			log.Errorf(g.c, "Github username %q not configured.", rev.Reviewer)
+			continue
+		}
+		sameTeam := false
+		if authorEmail != "" && g.Config.ReviewTrivialLines > 0 {
+			if sameTeam, err = shareTeam(g.c, g.githubEmail(rev.Reviewer), authorEmail); err != nil {
+				log.Errorf(g.c, "Failed to load teams of %q: %v", rev.Reviewer, err)
+			}
+		}
+		if ok, why := g.Config.reviewCredited(rev, lines, sameTeam); !ok {
+			log.Infof(g.c, "Not crediting %q for reviewing %s: %s", rev.Reviewer, prUrl, why)
+			continue
+		}
+		if _, err := grantRewards(g.c, g.r, user.Email, "pull-request-reviewed", prUrl, g.Repo.credits()); err != nil {
+			log.Errorf(g.c, "Failed to credit %q for reviewing %s: %v", rev.Reviewer, prUrl, err)
+			continue
+		}
+		rev.Credited = time.Now()
+		if _, err := datastore.Put(g.c, keys[i], &rev); err != nil {
+			log.Errorf(g.c, "Failed to save review %v: %v", keys[i], err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReviewCredited(t *testing.T) {
+	cfg := Configuration{ReviewMinComments: 2, ReviewTrivialLines: 20}
+	approved := ReviewRecord{Approved: true, Comments: 2}
+	credited := approved
+	credited.Credited = time.Now()
+	tests := []struct {
+		name     string
+		rev      ReviewRecord
+		lines    int
+		sameTeam bool
+		want     bool
+	}{
+		{"approved", approved, 5, false, true},
+		{"big teammate's pull request", approved, 20, true, true},
+		{"trivial teammate's pull request", approved, 19, true, false},
+		{"not approved", ReviewRecord{Comments: 5}, 100, false, false},
+		{"too few comments", ReviewRecord{Approved: true, Comments: 1}, 100, false, false},
+		{"already credited", credited, 100, false, false},
+	}
+	for _, test := range tests {
+		if got, why := cfg.reviewCredited(test.rev, test.lines, test.sameTeam); got != test.want {
+			t.Errorf("%s: got %v (%s), want %v", test.name, got, why, test.want)
+		}
+	}
+
+	// With no rules, any approval counts.
+	if ok, why := (Configuration{}).reviewCredited(ReviewRecord{Approved: true}, 1, true); !ok {
+		t.Errorf("Default rules rejected an approval: %s", why)
+	}
+}
+
+func TestCountComment(t *testing.T) {
+	var rev ReviewRecord
+	for _, id := range []int64{10, 11, 10, 11, 12} {
+		rev.countComment(id)
+	}
+	if rev.Comments != 3 {
+		t.Errorf("Redelivered comments were counted again: %d comments", rev.Comments)
+	}
+}
@@ -18,13 +18,60 @@ type Reward struct {
 	Type         string
 	Description  string
 
-	// Donation tracking
-	PreviousOwners  []string // this should be the parsed EmailAddress field
-	DonationDates   []time.Time
-	DonationMessage []string
+	// Set instead of EmailAddress for rewards in a team's shared pool.
+	Team string
 
-	Granted   time.Time
-	Dispensed time.Time
+	// Everything that has happened to this reward, oldest first.
+	History []RewardEvent
+
+	Granted     time.Time
+	Dispensed   time.Time
+	DispensedBy string
+	Revoked     time.Time // set when the reward is revoked or expires
+	Queued      time.Time // set while waiting to dispense from an offline dispenser
+}
+
+// The kinds of things that can happen to a reward.
+const (
+	EventGranted   = "granted"
+	EventDonated   = "donated"
+	EventDispensed = "dispensed"
+	EventRevoked   = "revoked"
+	EventRefunded  = "refunded"
+	EventExpired   = "expired"
+	EventQueued    = "queued"
+	EventPenalty   = "penalty"
+)
+
+// RewardEvent is a single hop in a reward's journey.
+type RewardEvent struct {
+	Kind    string
+	Actor   string // who did it, empty if chompy did it on its own
+	Owner   string // who holds the reward after the event
+	Time    time.Time
+	Message string
+}
+
+func (e RewardEvent) Summary() string {
+	switch e.Kind {
+	case EventGranted:
+		return fmt.Sprintf("Granted to %s", e.Owner)
+	case EventDonated:
+		return fmt.Sprintf("Donated by %s to %s", e.Actor, e.Owner)
+	case EventDispensed:
+		return fmt.Sprintf("Dispensed by %s", e.Actor)
+	case EventRevoked:
+		return fmt.Sprintf("Revoked by %s", e.Actor)
+	case EventRefunded:
+		return fmt.Sprintf("Refunded to %s", e.Owner)
+	case EventExpired:
+		return "Expired"
+	case EventPenalty:
+		return "Paid off a penalty"
+	case EventQueued:
+		return fmt.Sprintf("Queued by %s until the dispenser is back online", e.Actor)
+	}
+	return e.Kind
 }
 
 type Uid string
@@ -38,11 +85,18 @@ func (r Reward) Uid() Uid {
 	return Uid(hex.EncodeToString(hash_bytes[:]))
 }
 
-func (r Reward) Available() bool { return r.Dispensed.IsZero() && !r.Granted.IsZero() }
+func (r Reward) Available() bool {
+	return r.Dispensed.IsZero() && r.Revoked.IsZero() && r.Queued.IsZero() && !r.Granted.IsZero()
+}
 func (r Reward) Status() string {
-	if r.Available() {
+	switch {
+	case r.Available():
 		return "available"
-	} else {
+	case !r.Revoked.IsZero():
+		return "revoked"
+	case !r.Queued.IsZero() && r.Dispensed.IsZero():
+		return "queued"
+	default:
 		return "used"
 	}
 }
@@ -56,6 +110,8 @@ func (r Reward) Reason() string {
 		return fmt.Sprintf("You reviewed a pull request: %s", r.Description)
 	case "commit-merged":
 		return fmt.Sprintf("You committed some code (%s)", r.Description)
+	case "build-fixed":
+		return fmt.Sprintf("You fixed the build: %s", r.Description)
 	case "thanks":
 		return "You did something nice!"
 	case "manual":
@@ -64,33 +120,161 @@ func (r Reward) Reason() string {
 	return "Enjoy!"
 }
 
+func (r *Reward) record(kind, actor, msg string) {
+	r.History = append(r.History, RewardEvent{
+		Kind:    kind,
+		Actor:   actor,
+		Owner:   r.EmailAddress,
+		Time:    time.Now(),
+		Message: msg,
+	})
+}
+
+func (r *Reward) Grant() {
+	r.Granted = time.Now()
+	r.record(EventGranted, "", r.Description)
+}
 func (r *Reward) DonateTo(email, msg string) {
-	r.PreviousOwners = append(r.PreviousOwners, r.EmailAddress)
-	r.DonationDates = append(r.DonationDates, time.Now())
-	r.DonationMessage = append(r.DonationMessage, msg)
+	donor := r.EmailAddress
 	// Don't change the Email field because it's used for the Uid of the reward! :-/
 	r.EmailAddress = email
+	r.record(EventDonated, donor, msg)
+}
+func (r *Reward) Dispense(actor string) {
+	r.Dispensed = time.Now()
+	r.DispensedBy = actor
+	r.record(EventDispensed, actor, "")
 }
-func (r Reward) LastDonationTime() time.Time {
-	N := len(r.DonationDates)
-	if N == 0 {
-		return time.Time{}
+func (r *Reward) Refund(msg string) {
+	r.Dispensed = time.Time{}
+	r.DispensedBy = ""
+	r.record(EventRefunded, "", msg)
+}
+func (r *Reward) Queue(actor, msg string) {
+	r.Queued = time.Now()
+	r.record(EventQueued, actor, msg)
+}
+
+// Dequeue takes the reward out of the dispense queue.  It's recorded as a
+// refund if msg is set, otherwise the caller is about to dispense it.
+func (r *Reward) Dequeue(msg string) {
+	r.Queued = time.Time{}
+	if msg != "" {
+		r.record(EventRefunded, "", msg)
 	}
-	return r.DonationDates[N-1]
 }
-func (r Reward) LastDonor() string {
-	N := len(r.PreviousOwners)
-	if N == 0 {
-		return ""
+func (r *Reward) Revoke(actor, msg string) {
+	r.Revoked = time.Now()
+	r.record(EventRevoked, actor, msg)
+}
+func (r *Reward) PayPenalty(msg string) {
+	r.Revoked = time.Now()
+	r.record(EventPenalty, "", msg)
+}
+func (r *Reward) Expire(msg string) {
+	r.Revoked = time.Now()
+	r.record(EventExpired, "", msg)
+}
+
+func (r Reward) lastDonation() RewardEvent {
+	for i := len(r.History) - 1; i >= 0; i-- {
+		if r.History[i].Kind == EventDonated {
+			return r.History[i]
+		}
+	}
+	return RewardEvent{}
+}
+func (r Reward) Donated() bool               { return r.lastDonation().Kind == EventDonated }
+func (r Reward) LastDonationTime() time.Time { return r.lastDonation().Time }
+func (r Reward) LastDonor() string           { return r.lastDonation().Actor }
+func (r Reward) LastDonorMessage() string    { return r.lastDonation().Message }
+
+// Load implements datastore.PropertyLoadSaver so that rewards saved before
+// History existed get their history rebuilt from the old parallel donation
+// slices.  The old fields are dropped the next time the reward is saved.
+func (r *Reward) Load(props []datastore.Property) error {
+	var (
+		current         []datastore.Property
+		previousOwners  []string
+		donationDates   []time.Time
+		donationMessage []string
+	)
+	for _, p := range props {
+		switch p.Name {
+		case "PreviousOwners":
+			s, _ := p.Value.(string)
+			previousOwners = append(previousOwners, s)
+		case "DonationDates":
+			t, _ := p.Value.(time.Time)
+			donationDates = append(donationDates, t)
+		case "DonationMessage":
+			s, _ := p.Value.(string)
+			donationMessage = append(donationMessage, s)
+		default:
+			current = append(current, p)
+		}
+	}
+	if err := datastore.LoadStruct(r, current); err != nil {
+		return err
 	}
-	return r.PreviousOwners[N-1]
+	if len(r.History) == 0 {
+		r.History = legacyHistory(*r, previousOwners, donationDates, donationMessage)
+	}
+	return nil
+}
+
+func (r *Reward) Save() ([]datastore.Property, error) {
+	return datastore.SaveStruct(r)
 }
-func (r Reward) LastDonorMessage() string {
-	N := len(r.DonationMessage)
-	if N == 0 {
+
+// legacyHistory reconstructs the event history of a reward that was stored
+// with the old PreviousOwners/DonationDates/DonationMessage slices.
+func legacyHistory(r Reward, previousOwners []string, dates []time.Time, msgs []string) []RewardEvent {
+	if r.Granted.IsZero() {
+		return nil
+	}
+	at := func(list []string, i int) string {
+		if i < len(list) {
+			return list[i]
+		}
 		return ""
 	}
-	return r.DonationMessage[N-1]
+	owner := r.EmailAddress
+	if len(previousOwners) > 0 {
+		owner = previousOwners[0]
+	}
+	history := []RewardEvent{{
+		Kind:    EventGranted,
+		Owner:   owner,
+		Time:    r.Granted,
+		Message: r.Description,
+	}}
+	for i, donor := range previousOwners {
+		recipient := at(previousOwners, i+1)
+		if recipient == "" {
+			recipient = r.EmailAddress
+		}
+		var when time.Time
+		if i < len(dates) {
+			when = dates[i]
+		}
+		history = append(history, RewardEvent{
+			Kind:    EventDonated,
+			Actor:   donor,
+			Owner:   recipient,
+			Time:    when,
+			Message: at(msgs, i),
+		})
+	}
+	if !r.Dispensed.IsZero() {
+		history = append(history, RewardEvent{
+			Kind:  EventDispensed,
+			Actor: r.EmailAddress,
+			Owner: r.EmailAddress,
+			Time:  r.Dispensed,
+		})
+	}
+	return history
 }
 
 func loadReward(c context.Context, id Uid) (Reward, error) {
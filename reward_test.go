@@ -0,0 +1,56 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLegacyHistory(t *testing.T) {
+	granted := time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+	r := Reward{
+		EmailAddress: "carol@example.com",
+		Description:  "fixed the build",
+		Granted:      granted,
+		Dispensed:    granted.Add(72 * time.Hour),
+	}
+	history := legacyHistory(r,
+		[]string{"alice@example.com", "bob@example.com"},
+		[]time.Time{granted.Add(24 * time.Hour), granted.Add(48 * time.Hour)},
+		[]string{"thanks!", ""})
+
+	want := []RewardEvent{
+		{Kind: EventGranted, Owner: "alice@example.com", Time: granted, Message: "fixed the build"},
+		{Kind: EventDonated, Actor: "alice@example.com", Owner: "bob@example.com", Time: granted.Add(24 * time.Hour), Message: "thanks!"},
+		{Kind: EventDonated, Actor: "bob@example.com", Owner: "carol@example.com", Time: granted.Add(48 * time.Hour)},
+		{Kind: EventDispensed, Actor: "carol@example.com", Owner: "carol@example.com", Time: granted.Add(72 * time.Hour)},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("Wrong history length: %#v", history)
+	}
+	for i := range want {
+		if history[i] != want[i] {
+			t.Errorf("Event %d:\n got %#v\nwant %#v", i, history[i], want[i])
+		}
+	}
+
+	r.History = history
+	if r.LastDonor() != "bob@example.com" || r.LastDonorMessage() != "" {
+		t.Errorf("Wrong last donation: %q %q", r.LastDonor(), r.LastDonorMessage())
+	}
+}
+
+func TestQueuedReward(t *testing.T) {
+	r := Reward{EmailAddress: "alice@example.com"}
+	r.Grant()
+	r.Queue("alice@example.com", "Waiting for snackman")
+	if r.Available() || r.Status() != "queued" {
+		t.Errorf("Queued reward should be reserved, got %q", r.Status())
+	}
+	r.Dequeue("Queued dispense expired")
+	if !r.Available() {
+		t.Errorf("Expired queued reward should be available again, got %q", r.Status())
+	}
+	if last := r.History[len(r.History)-1]; last.Kind != EventRefunded {
+		t.Errorf("Expiry should be recorded as a refund: %#v", last)
+	}
+}
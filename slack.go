@@ -0,0 +1,348 @@
+package chompy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// Slack requests older than this are rejected as replays.
+const slackMaxSkew = 5 * time.Minute
+
+const slackUsage = "Usage:\n" +
+	"`/chompy balance` - how many credits you have\n" +
+	"`/chompy give @someone [n] [\"message\"]` - give someone n of your credits\n" +
+	"`/chompy dispense [dispenser] [code]` - dispense one of your credits\n" +
+	"`/chompy kudos @someone [\"message\"]` - thank someone with a new credit from your monthly kudos"
+
+// verifySlackRequest checks the signature Slack puts on every request: the
+// hex HMAC-SHA256 of "v0:<timestamp>:<body>" keyed with the app's signing
+// secret.
+func verifySlackRequest(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Bad timestamp %q", timestamp)
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > slackMaxSkew || skew < -slackMaxSkew {
+		return fmt.Errorf("Stale request: %v old", skew)
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(h.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("Signature doesn't match")
+	}
+	return nil
+}
+
+// slackCommand is a parsed /chompy command.
+type slackCommand struct {
+	Verb    string
+	UserId  string // the mentioned user, if any
+	Num     int
+	Message string
+	Args    []string // anything else
+}
+
+// Slack escapes mentions as <@U123ABC|name> (or just <@U123ABC>).
+var slackMention = regexp.MustCompile(`^<@([A-Z0-9]+)(\|[^>]*)?>$`)
+
+// splitSlackText splits a command into words, keeping quoted messages
+// (including the curly quotes Slack clients like to insert) together.
+func splitSlackText(text string) []string {
+	var words []string
+	var word []rune
+	quoted := false
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, string(word))
+		}
+		word = nil
+	}
+	for _, r := range text {
+		switch {
+		case r == '"' || r == '“' || r == '”':
+			if quoted {
+				words = append(words, string(word))
+				word = nil
+			} else {
+				flush()
+			}
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			flush()
+		default:
+			word = append(word, r)
+		}
+	}
+	flush()
+	return words
+}
+
+func parseSlackCommand(text string) (slackCommand, error) {
+	words := splitSlackText(text)
+	if len(words) == 0 {
+		return slackCommand{Verb: "help"}, nil
+	}
+	cmd := slackCommand{Verb: strings.ToLower(words[0]), Num: 1}
+	rest := words[1:]
+	switch cmd.Verb {
+	case "give", "kudos":
+		if len(rest) == 0 {
+			return cmd, fmt.Errorf("Who to %s?", cmd.Verb)
+		}
+		m := slackMention.FindStringSubmatch(rest[0])
+		if m == nil {
+			return cmd, fmt.Errorf("%q isn't someone on Slack, use @their-name", rest[0])
+		}
+		cmd.UserId, rest = m[1], rest[1:]
+		if cmd.Verb == "give" && len(rest) > 0 {
+			if n, err := strconv.Atoi(rest[0]); err == nil {
+				if n <= 0 {
+					return cmd, fmt.Errorf("Can't give %d credits", n)
+				}
+				cmd.Num, rest = n, rest[1:]
+			}
+		}
+		cmd.Message = strings.Join(rest, " ")
+	default:
+		if len(rest) > 0 {
+			cmd.Args = rest
+		}
+	}
+	return cmd, nil
+}
+
+// slackEmail looks up the email address of a Slack user, which needs a bot
+// token with the users:read.email scope.  It's returned as Slack has it,
+// since rewards are looked up by their exact EmailAddress, like the web pages
+// do with the signed in user's address.
+func slackEmail(c context.Context, cfg Configuration, userId string) (string, error) {
+	req, err := http.NewRequest("GET", "https://slack.com/api/users.info?user="+url.QueryEscape(userId), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.SlackBotToken)
+	resp, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Ok    bool
+		Error string
+		User  struct {
+			Profile struct{ Email string }
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", err
+	}
+	if !info.Ok || info.User.Profile.Email == "" {
+		return "", fmt.Errorf("Slack users.info for %s failed: %q", userId, info.Error)
+	}
+	return info.User.Profile.Email, nil
+}
+
+func (cfg Configuration) CanMintKudos(email string) bool {
+	for _, giver := range cfg.KudosGivers {
+		if strings.EqualFold(giver, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func slackReply(w http.ResponseWriter, inChannel bool, format string, args ...interface{}) {
+	responseType := "ephemeral"
+	if inChannel {
+		responseType = "in_channel"
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"response_type": responseType,
+		"text":          fmt.Sprintf(format, args...),
+	})
+}
+
+func HandleSlackCommand(w http.ResponseWriter, r *http.Request, c context.Context) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+	if cfg.SlackSigningSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf(c, "Can't read request body: %v", err)
+		http.Error(w, "Can't read request body", http.StatusBadRequest)
+		return
+	}
+	if err := verifySlackRequest(cfg.SlackSigningSecret, r.Header, body, time.Now()); err != nil {
+		log.Errorf(c, "Bad Slack request: %v", err)
+		http.Error(w, "Bad signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		log.Errorf(c, "Can't parse Slack command: %v\n%s", err, body)
+		http.Error(w, "Bad payload", http.StatusBadRequest)
+		return
+	}
+	log.Infof(c, "Slack command from %s (%s): %q", form.Get("user_name"), form.Get("user_id"), form.Get("text"))
+
+	cmd, err := parseSlackCommand(form.Get("text"))
+	if err != nil {
+		slackReply(w, false, "%v\n%s", err, slackUsage)
+		return
+	}
+	from, err := slackEmail(c, cfg, form.Get("user_id"))
+	if err != nil {
+		log.Errorf(c, "Can't find email of %s: %v", form.Get("user_id"), err)
+		slackReply(w, false, "Sorry, I don't know who you are.")
+		return
+	}
+	var to string
+	if cmd.UserId != "" {
+		if to, err = slackEmail(c, cfg, cmd.UserId); err != nil {
+			log.Errorf(c, "Can't find email of %s: %v", cmd.UserId, err)
+			slackReply(w, false, "Sorry, I don't know who <@%s> is.", cmd.UserId)
+			return
+		}
+		if strings.EqualFold(to, from) {
+			log.Warningf(c, "%q may be a narcissist: %s", from, cmd.Verb)
+			slackReply(w, false, "To yourself?  Really?")
+			return
+		}
+	}
+
+	switch cmd.Verb {
+	case "balance":
+		available, err := availableRewards(c, from)
+		if err != nil {
+			log.Criticalf(c, "Failed to load rewards for %q: %v", from, err)
+			slackReply(w, false, "Sorry, something went wrong.")
+			return
+		}
+		slackReply(w, false, "You have %d credits.  See them all at http://%s/me", len(available), r.Host)
+
+	case "give":
+		_, code, err := donateRewards(c, from, []string{to}, cmd.Message, nil, cmd.Num)
+		if err != nil {
+			log.Errorf(c, "Slack donation from %q failed (%d): %v", from, code, err)
+			slackReply(w, false, "%v", err)
+			return
+		}
+		if err := sendDonationEmail(c, r, from, to, cmd.Message, cmd.Num); err != nil {
+			log.Errorf(c, "Couldn't send email for donation to %q: %v", to, err)
+		}
+		slackReply(w, true, "<@%s> gave <@%s> %d chompy credits%s", form.Get("user_id"), cmd.UserId,
+			cmd.Num, quoteSlackMessage(cmd.Message))
+
+	case "kudos":
+		if code, err := giveKudos(c, r, cfg, from, to, cmd.Message, cfg.CanMintKudos(from)); err != nil {
+			log.Errorf(c, "Slack kudos from %q failed (%d): %v", from, code, err)
+			slackReply(w, false, "%v", err)
+			return
+		}
+		slackReply(w, true, "<@%s> gave <@%s> kudos%s", form.Get("user_id"), cmd.UserId,
+			quoteSlackMessage(cmd.Message))
+
+	case "dispense":
+		slackDispense(w, c, cfg, cmd, from, form.Get("response_url"))
+
+	default:
+		slackReply(w, false, slackUsage)
+	}
+}
+
+func quoteSlackMessage(msg string) string {
+	if msg == "" {
+		return "!"
+	}
+	return fmt.Sprintf(": \"%s\"", msg)
+}
+
+// slackDispense checks that a dispense can go ahead and then does it in the
+// background, since Slack only waits 3 seconds for a reply.
+func slackDispense(w http.ResponseWriter, c context.Context, cfg Configuration, cmd slackCommand, from, responseURL string) {
+	var name, code string
+	for _, arg := range cmd.Args {
+		if _, err := strconv.Atoi(arg); err == nil {
+			code = arg
+		} else {
+			name = arg
+		}
+	}
+	d, err := cfg.Dispenser(name)
+	if err != nil {
+		slackReply(w, false, "%v", err)
+		return
+	}
+	if !presenceOK(d, code) {
+		countDispense("no_presence")
+		slackReply(w, false, "Add the code shown on %s: `/chompy dispense %s <code>`", d.Name, d.Name)
+		return
+	}
+	available, err := availableRewards(c, from)
+	if err != nil {
+		log.Criticalf(c, "Failed to load rewards for %q: %v", from, err)
+		slackReply(w, false, "Sorry, something went wrong.")
+		return
+	}
+	if len(available) == 0 {
+		slackReply(w, false, "You don't have any credits left.")
+		return
+	}
+	id := Uid(available[0].StringID())
+	if err := slackDispenseLater.Call(c, id, d.Name, from, responseURL); err != nil {
+		log.Criticalf(c, "Failed to start dispensing %s for %q: %v", id, from, err)
+		slackReply(w, false, "Sorry, something went wrong.")
+		return
+	}
+	slackReply(w, false, "Dispensing from %s...", d.Name)
+}
+
+var slackDispenseLater = delay.Func("slack-dispense", func(c context.Context, id Uid, dispenser, from, responseURL string) error {
+	msg := "Enjoy!"
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		msg = "Sorry, something went wrong."
+	} else if d, err := cfg.Dispenser(dispenser); err != nil {
+		msg = err.Error()
+	} else if _, err := dispenseReward(c, id.Key(c), d, from); err != nil {
+		msg = fmt.Sprintf("Failed: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]string{"response_type": "ephemeral", "text": msg})
+	resp, err := urlfetch.Client(c).Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Errorf(c, "Couldn't tell %q how their dispense went (%s): %v", from, msg, err)
+		return nil // Don't retry the dispense.
+	}
+	resp.Body.Close()
+	return nil
+})
@@ -0,0 +1,70 @@
+package chompy
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A /chompy give command as sent by Slack, signed with slackSecret.
+const (
+	slackPayload   = `token=gIkuvaNzQIHg97ATvDxqgjtO&team_id=T0001&team_domain=example&channel_id=C2147483705&channel_name=dev&user_id=U2147483697&user_name=alice&command=%2Fchompy&text=give+%3C%40U0B2C3D4E%7Cbob%3E+2+%E2%80%9Cthanks+for+the+review%E2%80%9D&api_app_id=A0KRD7HC3&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2F1234%2F5678&trigger_id=13345224609.738474920.8088930838d88f008e0`
+	slackTimestamp = "1462060800"
+	slackSig       = "v0=1ae7776a7c5228982b70cc33cb5a6f4da3a87ef7f7c94d0a09f2634452d0fbb0"
+	slackSecret    = "e6b19c573432dcc6b075501d51b51bb8"
+)
+
+func TestVerifySlackRequest(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Slack-Request-Timestamp", slackTimestamp)
+	header.Set("X-Slack-Signature", slackSig)
+	sent := time.Unix(1462060800, 0)
+
+	if err := verifySlackRequest(slackSecret, header, []byte(slackPayload), sent.Add(time.Second)); err != nil {
+		t.Errorf("Valid request rejected: %v", err)
+	}
+	if err := verifySlackRequest(slackSecret, header, []byte(slackPayload+"&x=1"), sent); err == nil {
+		t.Errorf("Modified request accepted")
+	}
+	if err := verifySlackRequest("wrong", header, []byte(slackPayload), sent); err == nil {
+		t.Errorf("Request with the wrong secret accepted")
+	}
+	if err := verifySlackRequest(slackSecret, header, []byte(slackPayload), sent.Add(time.Hour)); err == nil {
+		t.Errorf("Replayed request accepted")
+	}
+}
+
+func TestParseSlackCommand(t *testing.T) {
+	form, err := url.ParseQuery(slackPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		text string
+		want slackCommand
+	}{
+		{form.Get("text"), slackCommand{Verb: "give", UserId: "U0B2C3D4E", Num: 2, Message: "thanks for the review"}},
+		{`give <@U0B2C3D4E> "nice"`, slackCommand{Verb: "give", UserId: "U0B2C3D4E", Num: 1, Message: "nice"}},
+		{"kudos <@U0B2C3D4E|bob> great demo", slackCommand{Verb: "kudos", UserId: "U0B2C3D4E", Num: 1, Message: "great demo"}},
+		{"Balance", slackCommand{Verb: "balance", Num: 1}},
+		{"dispense snackman 123456", slackCommand{Verb: "dispense", Num: 1, Args: []string{"snackman", "123456"}}},
+		{"", slackCommand{Verb: "help"}},
+	}
+	for _, tc := range testCases {
+		got, err := parseSlackCommand(tc.text)
+		if err != nil {
+			t.Errorf("%q: %v", tc.text, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q:\n got %#v\nwant %#v", tc.text, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{"give", "give bob 2", "give <@U0B2C3D4E> 0", "kudos"} {
+		if cmd, err := parseSlackCommand(bad); err == nil {
+			t.Errorf("%q should fail, got %#v", bad, cmd)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package snackbot
+
+import "fmt"
+
+type ErrorKind int
+
+const (
+	// The agent or the device behind it couldn't be reached.
+	Offline ErrorKind = iota + 1
+	// The agent didn't answer in time.  For dispenses the candy may or may
+	// not have come out.
+	Timeout
+	// The agent answered but refused the request.
+	Rejected
+	// The device reported that the candy wasn't dispensed.
+	NotDispensed
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case Offline:
+		return "offline"
+	case Timeout:
+		return "timeout"
+	case Rejected:
+		return "rejected"
+	case NotDispensed:
+		return "not_dispensed"
+	}
+	return fmt.Sprintf("ErrorKind(%d)", int(k))
+}
+
+// Error is returned for all failed requests to the agent.
+type Error struct {
+	Kind ErrorKind
+	Op   string // "status" or "dispense"
+
+	Err        error  // underlying error, if any
+	StatusCode int    // HTTP status from the agent, if it answered
+	Body       string // response body from the agent, if it answered
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("snackbot %s: %s: %v", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("snackbot %s: %s: %d %s", e.Op, e.Kind, e.StatusCode, e.Body)
+}
+
+func kindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return 0
+}
+
+func IsOffline(err error) bool  { return kindOf(err) == Offline }
+func IsTimeout(err error) bool  { return kindOf(err) == Timeout }
+func IsRejected(err error) bool { return kindOf(err) == Rejected }
+
+func IsNotDispensed(err error) bool { return kindOf(err) == NotDispensed }
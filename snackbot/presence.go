@@ -0,0 +1,54 @@
+package snackbot
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PresenceStep is how long each presence code is valid for.
+const PresenceStep = 60 * time.Second
+
+// PresenceCode returns the 6 digit code the agent shows at the machine during
+// the PresenceStep containing t, so that only people standing there can
+// dispense.  It is derived from the HMAC-SHA256 of "presence\n<step>" and must
+// match presenceCode() in electricimp/agent.js.
+func PresenceCode(secret string, t time.Time) string {
+	step := t.Unix() / int64(PresenceStep/time.Second)
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "presence\n%d", step)
+	n := binary.BigEndian.Uint32(h.Sum(nil)) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// CheckPresenceCode returns whether code is the presence code shown at the
+// machine at t, allowing for the code having just changed and for some
+// clock skew between chompy and the agent.
+func CheckPresenceCode(secret, code string, t time.Time) bool {
+	for _, offset := range []time.Duration{0, -PresenceStep, PresenceStep} {
+		if hmac.Equal([]byte(code), []byte(PresenceCode(secret, t.Add(offset)))) {
+			return true
+		}
+	}
+	return false
+}
+
+// PresencePageKey returns the key the agent's /presence page has to be opened
+// with, so that only the display at the machine can show the codes.  It is
+// the hex HMAC-SHA256 of "presence page" and must match presencePageKey() in
+// electricimp/agent.js.
+func PresencePageKey(secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("presence page"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// PresencePageURL returns the link to the /presence page of the agent at
+// agentURL.
+func PresencePageURL(agentURL, secret string) string {
+	return strings.TrimRight(agentURL, "/") + "/presence?key=" + PresencePageKey(secret)
+}
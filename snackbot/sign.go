@@ -0,0 +1,53 @@
+package snackbot
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying a request's signature.  The agent rejects requests whose
+// timestamp is too far from its own clock or whose nonce it has already
+// seen, so a captured request can't be replayed.
+const (
+	TimestampHeader = "X-Chompy-Timestamp"
+	NonceHeader     = "X-Chompy-Nonce"
+	SignatureHeader = "X-Chompy-Signature"
+)
+
+// Sign computes the signature of an agent request: the hex HMAC-SHA256 of
+// the method, path (relative to the agent URL), amount query parameter,
+// timestamp and nonce, separated by newlines.  This must match verify() in
+// electricimp/agent.js.
+func Sign(secret, method, path, amount, timestamp, nonce string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(strings.Join([]string{method, path, amount, timestamp, nonce}, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Client) sign(req *http.Request, path, amount string) error {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce[:])
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonceHex)
+	req.Header.Set(SignatureHeader, Sign(c.Secret, req.Method, path, amount, timestamp, nonceHex))
+	return nil
+}
+
+// SignBody computes the signature of a request sent by the agent to chompy,
+// such as telemetry: the hex HMAC-SHA256 of the body.  The body carries its
+// own timestamp.
+func SignBody(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
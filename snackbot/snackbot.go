@@ -0,0 +1,255 @@
+// Package snackbot is a client for the Electric Imp agent that drives the
+// candy dispenser (see electricimp/agent.js).
+package snackbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	DefaultTimeout       = 5 * time.Second
+	DefaultStatusRetries = 2
+
+	// MaxDispenseTime is the longest the agent runs the motor for; it must
+	// match MAX_AMOUNT in electricimp/agent.js.
+	MaxDispenseTime = 30 * time.Second
+)
+
+type Status struct {
+	Online bool `json:"online"`
+}
+
+// States of a dispense reported by the agent.
+const (
+	DispensePending = "pending"
+	DispenseDone    = "done"
+	DispenseFailed  = "failed"
+)
+
+// DispenseStatus is the agent's view of a single dispense.
+type DispenseStatus struct {
+	Id    string `json:"id"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Client talks to a single snackbot agent.  Clients are cheap; on App Engine
+// create one per request and set NewHTTP to urlfetch.Client.
+type Client struct {
+	AgentURL string
+	HTTP     *http.Client
+
+	// If set, builds the HTTP client for each request to the agent from a
+	// context carrying that request's deadline, instead of using HTTP.  It's
+	// needed on App Engine, where urlfetch ignores the request's context.
+	NewHTTP func(ctx context.Context) *http.Client
+
+	// Shared secret used to sign requests, see Sign.  Requests are unsigned
+	// if it's empty.
+	Secret string
+
+	// Timeout for each request to the agent.
+	Timeout time.Duration
+	// Number of times a failed status check is retried.  Dispenses are never
+	// retried since we can't tell whether the candy came out.
+	StatusRetries int
+	// Delay before the first retry, doubled for each following one.
+	RetryDelay time.Duration
+	// How often to ask the agent whether a dispense has finished.
+	PollInterval time.Duration
+
+	// Called after every request to the agent, e.g. to record metrics.
+	OnRequest func(endpoint string, elapsed time.Duration, err error)
+}
+
+func New(agentURL string, hc *http.Client) *Client {
+	return &Client{
+		AgentURL:      agentURL,
+		HTTP:          hc,
+		Timeout:       DefaultTimeout,
+		StatusRetries: DefaultStatusRetries,
+		RetryDelay:    200 * time.Millisecond,
+		PollInterval:  250 * time.Millisecond,
+	}
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	u := strings.TrimRight(c.AgentURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// Status asks the agent whether the device is connected, retrying a few
+// times if the agent can't be reached.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	delay := c.RetryDelay
+	var err error
+	for attempt := 0; attempt <= c.StatusRetries; attempt++ {
+		if attempt > 0 {
+			if werr := wait(ctx, delay); werr != nil {
+				return Status{}, &Error{Kind: Timeout, Op: "status", Err: werr}
+			}
+			delay *= 2
+		}
+		var body []byte
+		body, err = c.do(ctx, "status", "GET", "/status", nil)
+		if err == nil {
+			if err = json.Unmarshal(body, &status); err != nil {
+				return Status{}, &Error{Kind: Rejected, Op: "status",
+					Err: fmt.Errorf("cannot decode response %q: %v", body, err)}
+			}
+			return status, nil
+		}
+		if IsRejected(err) {
+			break
+		}
+	}
+	return Status{}, err
+}
+
+// Dispense asks the device to run the motor for d and returns the id of the
+// dispense, which can be passed to WaitForDispense.  Agents from before
+// dispenses could be confirmed return an empty id.  It is never retried.
+func (c *Client) Dispense(ctx context.Context, d time.Duration) (string, error) {
+	query := url.Values{"amount": {fmt.Sprintf("%f", d.Seconds())}}
+	body, err := c.do(ctx, "dispense", "POST", "/dispense", query)
+	if err != nil || len(body) == 0 {
+		return "", err
+	}
+	var status DispenseStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return "", &Error{Kind: Rejected, Op: "dispense",
+			Err: fmt.Errorf("cannot decode response %q: %v", body, err)}
+	}
+	return status.Id, nil
+}
+
+// DispenseStatus asks the agent how a dispense is going.
+func (c *Client) DispenseStatus(ctx context.Context, id string) (DispenseStatus, error) {
+	var status DispenseStatus
+	body, err := c.do(ctx, "dispense_status", "GET", "/dispense/status", url.Values{"id": {id}})
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return status, &Error{Kind: Rejected, Op: "dispense_status",
+			Err: fmt.Errorf("cannot decode response %q: %v", body, err)}
+	}
+	return status, nil
+}
+
+// WaitForDispense polls the agent until the device confirms that the
+// dispense finished, it fails, or timeout passes.  A dispense that isn't
+// confirmed in time returns a Timeout error.
+func (c *Client) WaitForDispense(ctx context.Context, id string, timeout time.Duration) error {
+	if id == "" {
+		return nil // Old agent, nothing to wait for.
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := c.DispenseStatus(ctx, id)
+		if err != nil && !IsTimeout(err) {
+			return err
+		}
+		switch status.State {
+		case DispenseDone:
+			return nil
+		case DispenseFailed:
+			return &Error{Kind: NotDispensed, Op: "dispense", Err: fmt.Errorf("%s", status.Error)}
+		}
+		if time.Now().After(deadline) {
+			return &Error{Kind: Timeout, Op: "dispense",
+				Err: fmt.Errorf("dispense %s not confirmed after %v", id, timeout)}
+		}
+		if err := wait(ctx, c.PollInterval); err != nil {
+			return &Error{Kind: Timeout, Op: "dispense",
+				Err: fmt.Errorf("dispense %s not confirmed: %v", id, err)}
+		}
+	}
+}
+
+// wait pauses for d, or until ctx is done.
+func wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) do(ctx context.Context, op, method, path string, query url.Values) (body []byte, err error) {
+	start := time.Now()
+	defer func() {
+		if c.OnRequest != nil {
+			c.OnRequest(op, time.Since(start), err)
+		}
+	}()
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(method, c.url(path, query), nil)
+	if err != nil {
+		return nil, &Error{Kind: Rejected, Op: op, Err: err}
+	}
+	if c.Secret != "" {
+		if err := c.sign(req, path, query.Get("amount")); err != nil {
+			return nil, &Error{Kind: Rejected, Op: op, Err: err}
+		}
+	}
+	hc := c.HTTP
+	if c.NewHTTP != nil {
+		hc = c.NewHTTP(ctx)
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &Error{Kind: classify(ctx, err), Op: op, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &Error{Kind: classify(ctx, err), Op: op, Err: err}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return body, nil
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		// The agent is up but the device isn't connected to it.
+		return nil, &Error{Kind: Offline, Op: op, StatusCode: resp.StatusCode, Body: string(body)}
+	default:
+		return nil, &Error{Kind: Rejected, Op: op, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+}
+
+func classify(ctx context.Context, err error) ErrorKind {
+	if ctx.Err() == context.DeadlineExceeded {
+		return Timeout
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return Timeout
+	}
+	return Offline
+}
@@ -0,0 +1,257 @@
+package snackbot
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/augustoroman/chompy/snackbot/snackbottest"
+)
+
+func newTestClient(a *snackbottest.Agent) *Client {
+	c := New(a.URL, nil)
+	c.RetryDelay = time.Millisecond
+	c.Timeout = 100 * time.Millisecond
+	return c
+}
+
+func TestStatus(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	c := newTestClient(a)
+
+	if status, err := c.Status(context.Background()); err != nil || !status.Online {
+		t.Errorf("Expected online, got %v %v", status, err)
+	}
+	a.SetOnline(false)
+	if status, err := c.Status(context.Background()); err != nil || status.Online {
+		t.Errorf("Expected offline, got %v %v", status, err)
+	}
+}
+
+func TestStatusRetries(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	c := newTestClient(a)
+
+	// Agent errors are rejections and aren't retried.
+	a.FailNext(1)
+	if _, err := c.Status(context.Background()); !IsRejected(err) {
+		t.Errorf("Expected rejected error, got %v", err)
+	}
+	if a.Requests() != 1 {
+		t.Errorf("Rejected status should not be retried: %d requests", a.Requests())
+	}
+
+	// Timeouts are retried until they succeed.
+	a.SetDelay(200 * time.Millisecond)
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		a.SetDelay(0)
+	}()
+	if status, err := c.Status(context.Background()); err != nil || !status.Online {
+		t.Errorf("Expected retry to succeed, got %v %v", status, err)
+	}
+}
+
+func TestStatusUnreachable(t *testing.T) {
+	a := snackbottest.NewAgent()
+	c := newTestClient(a)
+	a.Close()
+
+	if _, err := c.Status(context.Background()); !IsOffline(err) {
+		t.Errorf("Expected offline error, got %v", err)
+	}
+}
+
+func TestDispense(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	c := newTestClient(a)
+
+	id, err := c.Dispense(context.Background(), 450*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDispense(context.Background(), id, time.Second); err != nil {
+		t.Errorf("Dispense not confirmed: %v", err)
+	}
+	if got := a.Dispensed(); len(got) != 1 || got[0] != 0.45 {
+		t.Errorf("Wrong dispensed amounts: %v", got)
+	}
+
+	a.SetOnline(false)
+	if _, err := c.Dispense(context.Background(), time.Second); !IsOffline(err) {
+		t.Errorf("Expected offline error, got %v", err)
+	}
+
+	a.SetOnline(true)
+	a.SetDelay(200 * time.Millisecond)
+	before := a.Requests()
+	if _, err := c.Dispense(context.Background(), time.Second); !IsTimeout(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if a.Requests() != before+1 {
+		t.Errorf("Dispense must not be retried: %d requests", a.Requests()-before)
+	}
+}
+
+func TestWaitForDispense(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	c := newTestClient(a)
+	c.PollInterval = time.Millisecond
+
+	a.SetOutcome(snackbottest.Failed)
+	id, err := c.Dispense(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDispense(context.Background(), id, time.Second); !IsNotDispensed(err) {
+		t.Errorf("Expected not-dispensed error, got %v", err)
+	}
+
+	a.SetOutcome(snackbottest.Pending)
+	id, err = c.Dispense(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDispense(context.Background(), id, 20*time.Millisecond); !IsTimeout(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	if got := a.Dispensed(); len(got) != 0 {
+		t.Errorf("Nothing should have been dispensed: %v", got)
+	}
+}
+
+func TestNewHTTPGetsDeadline(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	c := newTestClient(a)
+
+	var deadlines []time.Time
+	c.NewHTTP = func(ctx context.Context) *http.Client {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Errorf("HTTP client built from a context without a deadline")
+		}
+		deadlines = append(deadlines, deadline)
+		return http.DefaultClient
+	}
+	if _, err := c.Status(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(deadlines) != 1 || deadlines[0].Sub(time.Now()) > c.Timeout {
+		t.Errorf("Expected one client with a %v deadline, got %v", c.Timeout, deadlines)
+	}
+}
+
+func TestWaitsStopWithContext(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	c := newTestClient(a)
+	c.PollInterval = time.Hour
+	c.RetryDelay = time.Hour
+
+	a.SetOutcome(snackbottest.Pending)
+	id, err := c.Dispense(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WaitForDispense(ctx, id, time.Hour); !IsTimeout(err) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	a.SetOnline(false)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	c.Status(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Status retries outlived the context: %v", elapsed)
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	a := snackbottest.NewAgent()
+	defer a.Close()
+	a.SetSecret("s3kr1t")
+	c := newTestClient(a)
+	c.PollInterval = time.Millisecond
+
+	if _, err := c.Dispense(context.Background(), time.Second); !IsRejected(err) {
+		t.Errorf("Unsigned dispense should be rejected, got %v", err)
+	}
+
+	c.Secret = "wrong"
+	if _, err := c.Dispense(context.Background(), time.Second); !IsRejected(err) {
+		t.Errorf("Badly signed dispense should be rejected, got %v", err)
+	}
+
+	c.Secret = "s3kr1t"
+	id, err := c.Dispense(context.Background(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForDispense(context.Background(), id, time.Second); err != nil {
+		t.Errorf("Signed dispense not confirmed: %v", err)
+	}
+	if got := a.Dispensed(); len(got) != 1 || got[0] != snackbottest.MaxAmount {
+		t.Errorf("Dispense should have been clamped: %v", got)
+	}
+
+	// Replaying a captured request is rejected.
+	req, _ := http.NewRequest("POST", a.URL+"/dispense?amount=1.000000", nil)
+	if err := c.sign(req, "/dispense", "1.000000"); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Attempt %d: got %d, want %d", i, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestPresenceCode(t *testing.T) {
+	now := time.Unix(1462060800, 0)
+	code := PresenceCode("s3cret", now)
+	if len(code) != 6 {
+		t.Errorf("Code should be 6 digits: %q", code)
+	}
+	if got := PresenceCode("s3cret", now.Add(PresenceStep-time.Second)); got != code {
+		t.Errorf("Code changed within a step: %q != %q", got, code)
+	}
+	if PresenceCode("other", now) == code {
+		t.Errorf("Different secrets should give different codes")
+	}
+
+	if !CheckPresenceCode("s3cret", code, now.Add(PresenceStep)) {
+		t.Errorf("Code from the previous step should still work")
+	}
+	if CheckPresenceCode("s3cret", code, now.Add(3*PresenceStep)) {
+		t.Errorf("Old code should be rejected")
+	}
+	if CheckPresenceCode("s3cret", "", now) {
+		t.Errorf("Empty code should be rejected")
+	}
+}
+
+func TestPresencePageURL(t *testing.T) {
+	want := "https://agent.example.com/abc/presence?key=59343ba0c04d1f6b24266dac3261e8d63861b34f71a8798f16474ef9b7e707bb"
+	if got := PresencePageURL("https://agent.example.com/abc/", "s3cret"); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+	if PresencePageKey("other") == PresencePageKey("s3cret") {
+		t.Errorf("Different secrets should give different keys")
+	}
+}
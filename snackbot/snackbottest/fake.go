@@ -0,0 +1,212 @@
+// Package snackbottest provides a fake snackbot agent for tests.
+package snackbottest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent is a fake Electric Imp agent that behaves like electricimp/agent.js.
+type Agent struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	online    bool
+	failures  int           // number of upcoming requests to fail with a 500
+	delay     time.Duration // how long to wait before answering
+	dispensed []float64     // amounts of all successful dispenses
+	requests  int
+
+	outcome   string            // what the device reports for new dispenses
+	dispenses map[string]string // dispense id -> state
+	nextId    int
+
+	secret string          // if set, dispense requests must be signed
+	nonces map[string]bool // nonces of signed requests already seen
+}
+
+// Like electricimp/agent.js, the fake clamps dispenses to MaxAmount seconds
+// and only accepts signatures within MaxClockSkew of its clock.
+const (
+	MaxAmount    = 5.0
+	MaxClockSkew = 60 * time.Second
+)
+
+// Outcomes the fake device can report for dispenses.
+const (
+	Done    = "done"
+	Failed  = "failed"
+	Pending = "pending" // the device never confirms
+)
+
+// NewAgent starts a fake agent with the device online.  Close it when done.
+func NewAgent() *Agent {
+	a := &Agent{
+		online:    true,
+		outcome:   Done,
+		dispenses: map[string]string{},
+		nonces:    map[string]bool{},
+	}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serve))
+	return a
+}
+
+func (a *Agent) SetOnline(online bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.online = online
+}
+
+// FailNext makes the next n requests fail with an internal error.
+func (a *Agent) FailNext(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures = n
+}
+
+// SetSecret requires dispense requests to be signed with secret.
+func (a *Agent) SetSecret(secret string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.secret = secret
+}
+
+// SetOutcome sets what the device reports for following dispenses.
+func (a *Agent) SetOutcome(outcome string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.outcome = outcome
+}
+
+// SetDelay makes the agent wait d before answering each request.
+func (a *Agent) SetDelay(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.delay = d
+}
+
+// Dispensed returns the amounts (in seconds) of all successful dispenses.
+func (a *Agent) Dispensed() []float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]float64(nil), a.dispensed...)
+}
+
+// Requests returns the total number of requests the agent has received.
+func (a *Agent) Requests() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests
+}
+
+func (a *Agent) serve(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.requests++
+	delay, online := a.delay, a.online
+	fail := a.failures > 0
+	if fail {
+		a.failures--
+	}
+	a.mu.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		http.Error(w, "the index 'foo' does not exist", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path != "/status" {
+		if err := a.verify(r); err != "" {
+			http.Error(w, err, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	switch r.URL.Path {
+	case "/status":
+		fmt.Fprintf(w, `{"online":%v}`, online)
+	case "/dispense":
+		if !online {
+			http.Error(w, "device not connected", http.StatusServiceUnavailable)
+			return
+		}
+		amount := 0.5
+		if s := r.URL.Query().Get("amount"); s != "" {
+			var err error
+			if amount, err = strconv.ParseFloat(s, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if amount <= 0 {
+			http.Error(w, "bad amount", http.StatusBadRequest)
+			return
+		}
+		if amount > MaxAmount {
+			amount = MaxAmount
+		}
+		a.mu.Lock()
+		a.nextId++
+		id := strconv.Itoa(a.nextId)
+		a.dispenses[id] = a.outcome
+		if a.outcome == Done {
+			a.dispensed = append(a.dispensed, amount)
+		}
+		a.mu.Unlock()
+		fmt.Fprintf(w, `{"id":%q}`, id)
+	case "/dispense/status":
+		id := r.URL.Query().Get("id")
+		a.mu.Lock()
+		state, ok := a.dispenses[id]
+		a.mu.Unlock()
+		if !ok {
+			http.Error(w, "unknown dispense", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%q,"state":%q}`, id, state)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// verify checks a request's signature the same way electricimp/agent.js does,
+// returning why it's invalid or "" if it's ok.
+func (a *Agent) verify(r *http.Request) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.secret == "" {
+		return ""
+	}
+	timestamp := r.Header.Get("X-Chompy-Timestamp")
+	nonce := r.Header.Get("X-Chompy-Nonce")
+	sig := r.Header.Get("X-Chompy-Signature")
+	if timestamp == "" || nonce == "" || sig == "" {
+		return "missing signature"
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "bad timestamp"
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return "stale request"
+	}
+	if a.nonces[nonce] {
+		return "replayed request"
+	}
+	msg := strings.Join([]string{r.Method, r.URL.Path, r.URL.Query().Get("amount"), timestamp, nonce}, "\n")
+	h := hmac.New(sha256.New, []byte(a.secret))
+	h.Write([]byte(msg))
+	if !hmac.Equal([]byte(hex.EncodeToString(h.Sum(nil))), []byte(sig)) {
+		return "bad signature"
+	}
+	a.nonces[nonce] = true
+	return ""
+}
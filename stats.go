@@ -0,0 +1,363 @@
+package chompy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// Stats are kept as counters that are bumped as things happen rather than
+// computed by scanning all rewards.  Each event increments counters for the
+// day, week and month it happened in, for the user involved, for the reward
+// type and overall.
+
+const (
+	statEarned    = "earned"
+	statDispensed = "dispensed"
+	statDonated   = "donated"
+)
+
+const (
+	statDay   = "day"
+	statWeek  = "week"
+	statMonth = "month"
+)
+
+type StatCounter struct {
+	Granularity string    // statDay, statWeek or statMonth
+	Start       time.Time // start of the period, UTC
+	Metric      string
+	Email       string // empty for counters across all users
+	Type        string // empty for counters across all reward types
+	Count       int
+}
+
+func (s StatCounter) name() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s",
+		s.Granularity, s.Start.Format("2006-01-02"), s.Metric, s.Email, s.Type)
+}
+
+func (s StatCounter) Key(c context.Context) *datastore.Key {
+	return datastore.NewKey(c, "stats", s.name(), 0, nil)
+}
+
+func periodStart(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch granularity {
+	case statWeek:
+		// Weeks start on Monday.
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case statMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+// statCounters returns the (zero count) counters that an event affects.
+func statCounters(metric, email, typ string, when time.Time) []StatCounter {
+	var counters []StatCounter
+	for _, g := range []string{statWeek, statMonth} {
+		start := periodStart(g, when)
+		counters = append(counters,
+			StatCounter{Granularity: g, Start: start, Metric: metric, Email: email},
+			StatCounter{Granularity: g, Start: start, Metric: metric, Type: typ},
+			StatCounter{Granularity: g, Start: start, Metric: metric})
+	}
+	return append(counters,
+		StatCounter{Granularity: statDay, Start: periodStart(statDay, when), Metric: metric})
+}
+
+// countStat records that n rewards of type typ were earned, dispensed or
+// donated by email.  The counters are shared by everyone, so they're updated
+// by a task that's retried when bursts of events contend for them instead of
+// here.  Failures are logged but otherwise ignored: stats should never get in
+// the way of candy.
+func countStat(c context.Context, metric, email, typ string, n int) {
+	if n == 0 {
+		return
+	}
+	if err := countStatLater.Call(c, metric, email, typ, n, time.Now()); err != nil {
+		log.Errorf(c, "Failed to count %s stats for %q (%s x%d): %v", metric, email, typ, n, err)
+	}
+}
+
+var countStatLater = delay.Func("count-stat", func(c context.Context, metric, email, typ string, n int, when time.Time) error {
+	counters := statCounters(metric, email, typ, when)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		keys := make([]*datastore.Key, len(counters))
+		current := make([]StatCounter, len(counters))
+		for i := range counters {
+			keys[i] = counters[i].Key(c)
+		}
+		err := datastore.GetMulti(c, keys, current)
+		if merr, ok := err.(appengine.MultiError); ok {
+			for i, err := range merr {
+				if err == datastore.ErrNoSuchEntity {
+					current[i] = counters[i]
+				} else if err != nil {
+					return err
+				}
+			}
+		} else if err != nil {
+			return err
+		}
+		for i := range current {
+			current[i].Count += n
+		}
+		_, err = datastore.PutMulti(c, keys, current)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+})
+
+// addRewardStats adds the events in a reward's history to counters, keyed by
+// counter name, the way countStat would have counted them as they happened.
+// In particular a dispense that was refunded didn't count.
+func addRewardStats(counters map[string]StatCounter, reward Reward) {
+	add := func(metric, email string, when time.Time) {
+		for _, counter := range statCounters(metric, email, reward.Type, when) {
+			existing, ok := counters[counter.name()]
+			if !ok {
+				existing = counter
+			}
+			existing.Count++
+			counters[counter.name()] = existing
+		}
+	}
+	for i, e := range reward.History {
+		switch e.Kind {
+		case EventGranted:
+			owner := e.Owner
+			if reward.Team != "" {
+				owner = reward.Email
+			}
+			add(statEarned, owner, e.Time)
+		case EventDonated:
+			add(statDonated, e.Actor, e.Time)
+		case EventDispensed:
+			if i+1 < len(reward.History) && reward.History[i+1].Kind == EventRefunded {
+				continue
+			}
+			add(statDispensed, e.Actor, e.Time)
+		}
+	}
+}
+
+type LeaderboardEntry struct {
+	Email string `json:"email"`
+	Count int    `json:"count"`
+}
+
+type TypeCount struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+type DayCount struct {
+	Day   time.Time `json:"day"`
+	Count int       `json:"count"`
+}
+
+type Stats struct {
+	Granularity  string                        `json:"granularity"`
+	Start        time.Time                     `json:"start"`
+	Leaderboards map[string][]LeaderboardEntry `json:"leaderboards"`
+	EarnedByType []TypeCount                   `json:"earned_by_type"`
+	Consumption  []DayCount                    `json:"consumption"`
+}
+
+const leaderboardSize = 10
+
+func loadStats(c context.Context, granularity string, start time.Time) (Stats, error) {
+	stats := Stats{
+		Granularity:  granularity,
+		Start:        start,
+		Leaderboards: map[string][]LeaderboardEntry{},
+	}
+
+	for _, metric := range []string{statEarned, statDispensed, statDonated} {
+		var counters []StatCounter
+		_, err := datastore.NewQuery("stats").
+			Filter("Granularity =", granularity).
+			Filter("Start =", start).
+			Filter("Metric =", metric).
+			Filter("Type =", "").
+			Order("-Count").
+			Limit(leaderboardSize+1). // +1 for the all-users counter
+			GetAll(c, &counters)
+		if err != nil {
+			return stats, err
+		}
+		entries := []LeaderboardEntry{}
+		for _, counter := range counters {
+			if counter.Email != "" && len(entries) < leaderboardSize {
+				entries = append(entries, LeaderboardEntry{counter.Email, counter.Count})
+			}
+		}
+		stats.Leaderboards[metric] = entries
+	}
+
+	var byType []StatCounter
+	_, err := datastore.NewQuery("stats").
+		Filter("Granularity =", granularity).
+		Filter("Start =", start).
+		Filter("Metric =", statEarned).
+		Filter("Email =", "").
+		GetAll(c, &byType)
+	if err != nil {
+		return stats, err
+	}
+	stats.EarnedByType = []TypeCount{}
+	for _, counter := range byType {
+		if counter.Type != "" {
+			stats.EarnedByType = append(stats.EarnedByType, TypeCount{counter.Type, counter.Count})
+		}
+	}
+	sort.Slice(stats.EarnedByType, func(i, j int) bool {
+		return stats.EarnedByType[i].Count > stats.EarnedByType[j].Count
+	})
+
+	var days []StatCounter
+	_, err = datastore.NewQuery("stats").
+		Filter("Granularity =", statDay).
+		Filter("Metric =", statDispensed).
+		Filter("Start >=", start.AddDate(0, 0, -90)).
+		Order("Start").
+		GetAll(c, &days)
+	if err != nil {
+		return stats, err
+	}
+	stats.Consumption = []DayCount{}
+	for _, counter := range days {
+		stats.Consumption = append(stats.Consumption, DayCount{counter.Start, counter.Count})
+	}
+	return stats, nil
+}
+
+func statsParams(r *http.Request) (string, time.Time, error) {
+	granularity := r.FormValue("period")
+	if granularity == "" {
+		granularity = statWeek
+	}
+	if granularity != statWeek && granularity != statMonth {
+		return "", time.Time{}, fmt.Errorf("Unknown period %q", granularity)
+	}
+	when := time.Now()
+	if date := r.FormValue("date"); date != "" {
+		var err error
+		if when, err = time.Parse("2006-01-02", date); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return granularity, periodStart(granularity, when), nil
+}
+
+func ShowStats(w http.ResponseWriter, r *http.Request, c context.Context) {
+	if user.Current(c) == nil {
+		url, _ := user.LoginURL(c, r.URL.String())
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	granularity, start, err := statsParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := loadStats(c, granularity, start)
+	if err != nil {
+		log.Criticalf(c, "Failed to load stats: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	params := struct {
+		Stats
+		Prev, Next string
+	}{stats, periodStart(granularity, start.AddDate(0, 0, -1)).Format("2006-01-02"), ""}
+	if granularity == statWeek {
+		params.Next = start.AddDate(0, 0, 7).Format("2006-01-02")
+	} else {
+		params.Next = start.AddDate(0, 1, 0).Format("2006-01-02")
+	}
+	if err := statsHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render stats template: %v", err)
+	}
+}
+
+func ShowStatsJson(w http.ResponseWriter, r *http.Request, c context.Context) {
+	if user.Current(c) == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	granularity, start, err := statsParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := loadStats(c, granularity, start)
+	if err != nil {
+		log.Criticalf(c, "Failed to load stats: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// RebuildStats recomputes all counters from the reward histories.  It's only
+// needed once to seed the counters with rewards from before stats existed.
+func RebuildStats(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+
+	counters := map[string]StatCounter{}
+	it := datastore.NewQuery("rewards").Run(c)
+	numRewards := 0
+	for {
+		var reward Reward
+		_, err := it.Next(&reward)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			log.Criticalf(c, "Failed to read rewards: %v", err)
+			http.Error(w, "Failed to read rewards", http.StatusInternalServerError)
+			return
+		}
+		numRewards++
+		addRewardStats(counters, reward)
+	}
+
+	var keys []*datastore.Key
+	var values []StatCounter
+	for _, counter := range counters {
+		keys = append(keys, counter.Key(c))
+		values = append(values, counter)
+	}
+	const batchSize = 500
+	for i := 0; i < len(keys); i += batchSize {
+		end := i + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := datastore.PutMulti(c, keys[i:end], values[i:end]); err != nil {
+			log.Criticalf(c, "Failed to save stats: %v", err)
+			http.Error(w, "Failed to save stats", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Infof(c, "Rebuilt %d stat counters from %d rewards", len(keys), numRewards)
+	fmt.Fprintf(w, "Rebuilt %d stat counters from %d rewards\n", len(keys), numRewards)
+}
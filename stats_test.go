@@ -0,0 +1,72 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriodStart(t *testing.T) {
+	// A Sunday evening in California is Monday in UTC.
+	when := time.Date(2017, 4, 9, 20, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	tests := []struct {
+		granularity string
+		want        time.Time
+	}{
+		{statDay, time.Date(2017, 4, 10, 0, 0, 0, 0, time.UTC)},
+		{statWeek, time.Date(2017, 4, 10, 0, 0, 0, 0, time.UTC)},
+		{statMonth, time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		if got := periodStart(test.granularity, when); !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.granularity, got, test.want)
+		}
+	}
+
+	sunday := time.Date(2017, 4, 16, 12, 0, 0, 0, time.UTC)
+	if got := periodStart(statWeek, sunday); !got.Equal(time.Date(2017, 4, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Sunday should belong to the previous Monday's week, got %v", got)
+	}
+}
+
+func TestAddRewardStats(t *testing.T) {
+	monday := time.Date(2017, 4, 10, 12, 0, 0, 0, time.UTC)
+	tuesday := monday.AddDate(0, 0, 1)
+	counters := map[string]StatCounter{}
+	addRewardStats(counters, Reward{Type: "pr", History: []RewardEvent{
+		{Kind: EventGranted, Owner: "a@x.com", Time: monday},
+		{Kind: EventDonated, Actor: "a@x.com", Owner: "b@x.com", Time: monday},
+		{Kind: EventDispensed, Actor: "b@x.com", Time: monday},
+		{Kind: EventRefunded, Time: monday},
+		{Kind: EventDispensed, Actor: "b@x.com", Time: tuesday},
+	}})
+	addRewardStats(counters, Reward{Type: "review", History: []RewardEvent{
+		{Kind: EventGranted, Owner: "b@x.com", Time: tuesday},
+	}})
+
+	count := func(g string, when time.Time, metric, email, typ string) int {
+		return counters[StatCounter{Granularity: g, Start: periodStart(g, when),
+			Metric: metric, Email: email, Type: typ}.name()].Count
+	}
+	tests := []struct {
+		granularity        string
+		when               time.Time
+		metric, email, typ string
+		want               int
+	}{
+		{statWeek, monday, statEarned, "", "", 2},
+		{statWeek, monday, statEarned, "a@x.com", "", 1},
+		{statWeek, monday, statEarned, "b@x.com", "", 1},
+		{statMonth, monday, statEarned, "", "pr", 1},
+		{statWeek, monday, statDonated, "a@x.com", "", 1},
+		// The refunded dispense doesn't count.
+		{statWeek, monday, statDispensed, "b@x.com", "", 1},
+		{statDay, monday, statDispensed, "", "", 0},
+		{statDay, tuesday, statDispensed, "", "", 1},
+	}
+	for _, test := range tests {
+		if got := count(test.granularity, test.when, test.metric, test.email, test.typ); got != test.want {
+			t.Errorf("%s %s of %q %q: got %d, want %d",
+				test.granularity, test.metric, test.email, test.typ, got, test.want)
+		}
+	}
+}
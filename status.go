@@ -1,17 +1,23 @@
 package chompy
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
-
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 )
 
 type Status struct {
-	Online bool `json:"online"`
+	Online     bool              `json:"online"` // whether any dispenser is online
+	Dispensers []DispenserStatus `json:"dispensers"`
+}
+
+// PresenceRequired returns whether any dispenser needs a presence code.
+func (s Status) PresenceRequired() bool {
+	for _, d := range s.Dispensers {
+		if d.RequiresPresence {
+			return true
+		}
+	}
+	return false
 }
 
 func GetChompyStatus(c context.Context) Status {
@@ -21,23 +27,9 @@ func GetChompyStatus(c context.Context) Status {
 		return Status{}
 	}
 
-	client := urlfetch.Client(c)
-	resp, err := client.Get(cfg.StatusUrl())
-	if err != nil {
-		log.Criticalf(c, "Could not contact electric imp: %v", err)
-		return Status{}
+	status := Status{Dispensers: cachedDispenserStatuses(c, cfg.Dispensers)}
+	for _, d := range status.Dispensers {
+		status.Online = status.Online || d.Online
 	}
-	defer resp.Body.Close()
-	respContent, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		log.Criticalf(c, "Could not contact electric imp: %s", respContent)
-		return Status{}
-	}
-	var status Status
-	if err := json.Unmarshal(respContent, &status); err != nil {
-		log.Criticalf(c, "Cannot decode response: %v\n%s", err, respContent)
-		return Status{}
-	}
-
 	return status
 }
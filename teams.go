@@ -0,0 +1,395 @@
+package chompy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	netmail "net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+)
+
+// Team is a named group of users, e.g. "frontend", that credits can be
+// donated to.  Teams also have a shared pool of credits that any member may
+// dispense from.
+type Team struct {
+	Name    string
+	Members []string // parsed, lowercased email addresses
+
+	// How many pool credits each member may dispense per day, 0 for no limit.
+	MemberDailyLimit int
+}
+
+// TeamBalance is a user's view of one of their teams' pool.
+type TeamBalance struct {
+	Team      Team
+	Available int // credits in the pool
+	Remaining int // credits this member may still dispense today, -1 if unlimited
+}
+
+func (b TeamBalance) CanDispense() bool { return b.Available > 0 && b.Remaining != 0 }
+
+func teamKey(c context.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, "teams", strings.ToLower(name), 0, nil)
+}
+
+func loadTeam(c context.Context, name string) (Team, error) {
+	var t Team
+	err := datastore.Get(c, teamKey(c, name), &t)
+	return t, err
+}
+
+func loadTeams(c context.Context) ([]Team, error) {
+	var teams []Team
+	_, err := datastore.NewQuery("teams").Order("Name").GetAll(c, &teams)
+	return teams, err
+}
+
+func loadTeamsFor(c context.Context, email string) ([]Team, error) {
+	var teams []Team
+	_, err := datastore.NewQuery("teams").Filter("Members =", strings.ToLower(email)).GetAll(c, &teams)
+	return teams, err
+}
+
+func loadTeamPool(c context.Context, name string) ([]*datastore.Key, []Reward, error) {
+	var rewards []Reward
+	keys, err := datastore.NewQuery("rewards").
+		Filter("Team =", name).
+		Order("-Granted").
+		GetAll(c, &rewards)
+	return keys, rewards, err
+}
+
+// TeamDispenses counts the pool credits a member has dispensed in a (UTC)
+// day.  It's checked and bumped in a transaction before each dispense so that
+// concurrent dispenses can't both squeeze under the limit.
+type TeamDispenses struct {
+	Team  string
+	Email string
+	Day   time.Time
+	Count int
+}
+
+// teamDispensesName names email's counter on team for the day of now.
+func teamDispensesName(team, email string, now time.Time) string {
+	return fmt.Sprintf("%s|%s|%s", strings.ToLower(team), strings.ToLower(email),
+		periodStart(statDay, now).Format("2006-01-02"))
+}
+
+func teamDispensesKey(c context.Context, team, email string, now time.Time) *datastore.Key {
+	return datastore.NewKey(c, "team_dispenses", teamDispensesName(team, email, now), 0, nil)
+}
+
+var errTeamLimit = errors.New("team daily limit reached")
+
+// use counts n dispenses, or takes them back if n is negative.  limit is 0
+// for no limit.
+func (d *TeamDispenses) use(n, limit int) error {
+	if n > 0 && limit > 0 && d.Count+n > limit {
+		return errTeamLimit
+	}
+	d.Count += n
+	if d.Count < 0 {
+		d.Count = 0
+	}
+	return nil
+}
+
+// dispensedToday counts the pool credits a member has dispensed today.
+func dispensedToday(c context.Context, team, email string) (int, error) {
+	var d TeamDispenses
+	err := datastore.Get(c, teamDispensesKey(c, team, email, time.Now()), &d)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return d.Count, err
+}
+
+// useTeamDispenses counts n dispenses by email from team's pool on the day of
+// now, or gives them back if n is negative.
+func useTeamDispenses(c context.Context, team Team, email string, n int, now time.Time) error {
+	key := teamDispensesKey(c, team.Name, email, now)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		d := TeamDispenses{Team: team.Name, Email: strings.ToLower(email), Day: periodStart(statDay, now)}
+		if err := datastore.Get(c, key, &d); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := d.use(n, team.MemberDailyLimit); err != nil {
+			return err
+		}
+		_, err := datastore.Put(c, key, &d)
+		return err
+	}, nil)
+}
+
+func teamBalance(c context.Context, team Team, email string) (TeamBalance, error) {
+	balance := TeamBalance{Team: team, Remaining: -1}
+	_, pool, err := loadTeamPool(c, team.Name)
+	if err != nil {
+		return balance, err
+	}
+	for _, reward := range pool {
+		if reward.Available() {
+			balance.Available++
+		}
+	}
+	if team.MemberDailyLimit > 0 {
+		used, err := dispensedToday(c, team.Name, email)
+		if err != nil {
+			return balance, err
+		}
+		balance.Remaining = team.MemberDailyLimit - used
+		if balance.Remaining < 0 {
+			balance.Remaining = 0
+		}
+	}
+	return balance, nil
+}
+
+func teamBalances(c context.Context, email string) ([]TeamBalance, error) {
+	teams, err := loadTeamsFor(c, email)
+	if err != nil {
+		return nil, err
+	}
+	var balances []TeamBalance
+	for _, team := range teams {
+		balance, err := teamBalance(c, team, email)
+		if err != nil {
+			return nil, err
+		}
+		balances = append(balances, balance)
+	}
+	return balances, nil
+}
+
+// grantTeamReward adds a credit to a team's shared pool and lets all of the
+// members know about it.
+func grantTeamReward(c context.Context, r *http.Request, teamName, typ, desc string) (code int, err error) {
+	team, err := loadTeam(c, teamName)
+	if err == datastore.ErrNoSuchEntity {
+		log.Errorf(c, "Reward granted to unknown team %q", teamName)
+		return http.StatusBadRequest, fmt.Errorf("No such team: %q", teamName)
+	} else if err != nil {
+		log.Errorf(c, "Failed to load team %q: %v", teamName, err)
+		return http.StatusInternalServerError, fmt.Errorf("Failed to load team")
+	}
+
+	reward := Reward{
+		Ip: r.RemoteAddr,
+
+		Email:       "team:" + team.Name,
+		Team:        team.Name,
+		Type:        typ,
+		Description: desc,
+	}
+	reward.Grant()
+
+	log.Infof(c, "Granting reward to team %s for %s: %s", team.Name, typ, desc)
+
+	key := reward.Uid().Key(c)
+	if err := datastore.Get(c, key, &reward); err == nil {
+		log.Errorf(c, "Duplicate reward attempt %v: %#v", key, reward)
+		return http.StatusConflict, fmt.Errorf("Reward already issued")
+	}
+	if _, err := datastore.Put(c, key, &reward); err != nil {
+		log.Errorf(c, "Failed to save reward %v: %v\nReward:%#v", key, err, reward)
+		return http.StatusInternalServerError, fmt.Errorf("Failed to save reward")
+	}
+	noteReward(c, reward.Uid())
+	countStat(c, statEarned, reward.Email, reward.Type, 1)
+	metricGrants.WithLabelValues(reward.Type, grantSource(r)).Inc()
+
+	if len(team.Members) == 0 {
+		return http.StatusOK, nil
+	}
+	data := map[string]string{
+		"team":     team.Name,
+		"reason":   reward.Description,
+		"home_url": fmt.Sprintf("http://%s/me", r.Host),
+	}
+	msg := &mail.Message{
+		Sender:   fmt.Sprintf("Chompy <notify@%s.appspotmail.com>", appengine.AppID(c)),
+		To:       team.Members,
+		Subject:  fmt.Sprintf("Team %s got candy!", team.Name),
+		Body:     renderTemplateOrDie(teamEmailTextTpl, data),
+		HTMLBody: renderTemplateOrDie(teamEmailHtmlTpl, data),
+	}
+	if err := mail.Send(c, msg); err != nil {
+		log.Errorf(c, "Couldn't send email for team reward %v: %v\n%v", key, err, reward)
+		return http.StatusInternalServerError, fmt.Errorf("Failed to send notification email")
+	}
+
+	log.Infof(c, "Granted team reward %v and sent notification email: %#v", key, reward)
+	return http.StatusOK, nil
+}
+
+// DispenseTeamReward dispenses the oldest credit in a team's pool for one of
+// the team's members.
+func DispenseTeamReward(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	team, err := loadTeam(c, p["name"])
+	if err == datastore.ErrNoSuchEntity || (err == nil && !team.HasMember(u.Email)) {
+		http.Error(w, "No such team", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to load team %q: %v", p["name"], err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	keys, pool, err := loadTeamPool(c, team.Name)
+	if err != nil {
+		log.Criticalf(c, "Failed to load pool for team %q: %v", team.Name, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	idx := -1
+	for i := len(pool) - 1; i >= 0; i-- {
+		if pool[i].Available() {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		countDispense("unavailable")
+		http.Error(w, "No team credits left", http.StatusGone)
+		return
+	}
+
+	d, err := cfg.Dispenser(r.FormValue("dispenser"))
+	if err != nil {
+		countDispense("no_dispenser")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkPresence(w, r, d) {
+		return
+	}
+	now := time.Now()
+	if err := useTeamDispenses(c, team, u.Email, 1, now); err == errTeamLimit {
+		countDispense("team_limit")
+		http.Error(w, fmt.Sprintf("You've already used your %d team credits for today",
+			team.MemberDailyLimit), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to count team %q dispense by %q: %v", team.Name, u.Email, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if code, err := dispenseReward(c, keys[idx], d, u.Email); err != nil {
+		if err := useTeamDispenses(c, team, u.Email, -1, now); err != nil {
+			log.Errorf(c, "Failed to give back team %q dispense of %q: %v", team.Name, u.Email, err)
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	log.Infof(c, "%q dispensed team %q reward %s", u.Email, team.Name, pool[idx].Uid())
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
+}
+
+func (t Team) HasMember(email string) bool {
+	for _, m := range t.Members {
+		if strings.EqualFold(m, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEmailList parses a comma or newline separated list of addresses,
+// accepting the same "Name (addr)" form as single addresses elsewhere.  Names
+// may contain spaces, so spaces don't separate addresses.
+func parseEmailList(raw string) ([]string, error) {
+	raw = strings.Replace(raw, "(", "<", -1)
+	raw = strings.Replace(raw, ")", ">", -1)
+	raw = strings.Replace(raw, "\n", ",", -1)
+	var emails []string
+	for _, part := range strings.Split(raw, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		addr, err := netmail.ParseAddress(part)
+		if err != nil {
+			return nil, fmt.Errorf("Bad email %q: %v", part, err)
+		}
+		emails = append(emails, addr.Address)
+	}
+	return emails, nil
+}
+
+func ManageTeams(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+
+	var message string
+	if r.Method == "POST" {
+		name := strings.TrimSpace(r.FormValue("name"))
+		members, err := parseEmailList(r.FormValue("members"))
+		if name == "" && err == nil {
+			err = fmt.Errorf("Missing team name")
+		}
+		limit := 0
+		if err == nil && r.FormValue("limit") != "" {
+			limit, err = strconv.Atoi(r.FormValue("limit"))
+		}
+		if err == nil && r.FormValue("delete") != "" {
+			err = datastore.Delete(c, teamKey(c, name))
+		} else if err == nil {
+			// Lowercased so that loadTeamsFor finds them whatever the case.
+			for i := range members {
+				members[i] = strings.ToLower(members[i])
+			}
+			sort.Strings(members)
+			team := Team{Name: name, Members: members, MemberDailyLimit: limit}
+			_, err = datastore.Put(c, teamKey(c, name), &team)
+		}
+		if err != nil {
+			log.Errorf(c, "Failed to update team %q: %v", name, err)
+			message = fmt.Sprintf("Failed to update team %q: %v", name, err)
+		} else {
+			log.Infof(c, "%q updated team %q: %q", u.Email, name, members)
+			message = fmt.Sprintf("Team %q updated!", name)
+		}
+	}
+
+	teams, err := loadTeams(c)
+	if err != nil {
+		log.Criticalf(c, "Failed to load teams: %v", err)
+		http.Error(w, "Cannot load teams", http.StatusInternalServerError)
+		return
+	}
+
+	params := struct {
+		Message string
+		Teams   []Team
+	}{message, teams}
+	if err := teamsHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render teams page: %v", err)
+	}
+}
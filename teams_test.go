@@ -0,0 +1,39 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTeamDispensesName(t *testing.T) {
+	// A Sunday evening in California is Monday in UTC.
+	when := time.Date(2026, 4, 5, 20, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	if got, want := teamDispensesName("Frontend", "Alice@Example.com", when), "frontend|alice@example.com|2026-04-06"; got != want {
+		t.Errorf("teamDispensesName = %q, want %q", got, want)
+	}
+}
+
+func TestTeamDispensesUse(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		count, n, limit int
+		wantErr         error
+		wantCount       int
+	}{
+		{"first of the day", 0, 1, 2, nil, 1},
+		{"last one", 1, 1, 2, nil, 2},
+		{"over the limit", 2, 1, 2, errTeamLimit, 2},
+		{"limit lowered", 5, 1, 2, errTeamLimit, 5},
+		{"no limit", 7, 1, 0, nil, 8},
+		{"give back", 2, -1, 2, nil, 1},
+		{"give back nothing", 0, -1, 2, nil, 0},
+	} {
+		d := TeamDispenses{Count: test.count}
+		if err := d.use(test.n, test.limit); err != test.wantErr {
+			t.Errorf("%s: use(%d) error %v, want %v", test.name, test.n, err, test.wantErr)
+		}
+		if d.Count != test.wantCount {
+			t.Errorf("%s: count %d, want %d", test.name, d.Count, test.wantCount)
+		}
+	}
+}
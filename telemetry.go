@@ -0,0 +1,361 @@
+package chompy
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/user"
+
+	"github.com/go-martini/martini"
+
+	"github.com/augustoroman/chompy/snackbot"
+)
+
+const (
+	// Telemetry reports older than this are rejected as replays.  Newer ones
+	// are rejected if they've been seen before.
+	maxTelemetrySkew = 5 * time.Minute
+	// Most reports remembered to tell whether they've been seen before.
+	telemetryWindow = 100
+	// Consecutive dispenses where the drop sensor saw no candy before we
+	// suspect a jam.
+	jamThreshold = 2
+	// Fraction of capacity left at which admins are told to refill.
+	lowInventoryFraction = 0.15
+)
+
+// TelemetryReport is what the device (via the agent) sends to /telemetry.
+type TelemetryReport struct {
+	AgentURL     string  `json:"agent_url"`
+	Timestamp    int64   `json:"timestamp"`
+	Sequence     int64   `json:"sequence"` // counts the agent's reports, restarting with the agent
+	Event        string  `json:"event"`    // "boot" or "dispense"
+	DispenseId   string  `json:"dispense_id"`
+	MotorSeconds float64 `json:"motor_seconds"` // how long the motor ran for this dispense
+	Drops        int     `json:"drops"`         // candy drops seen by the sensor, -1 if there's no sensor
+	RSSI         int     `json:"rssi"`
+}
+
+// Telemetry is what we know about the physical state of a dispenser.
+type Telemetry struct {
+	Dispenser  string
+	LastReport time.Time
+	LastBoot   time.Time
+	RSSI       int
+
+	// Timestamps and sequence numbers of the reports accepted within
+	// maxTelemetrySkew, to reject replays.  The agent sends reports
+	// asynchronously, so they may arrive out of order.
+	SeenTimestamps []int64 `datastore:",noindex"`
+	SeenSequences  []int64 `datastore:",noindex"`
+
+	TotalMotorSeconds       float64
+	MotorSecondsSinceRefill float64
+	Refilled                time.Time
+
+	MissedDrops         int // consecutive dispenses where the sensor saw no candy
+	JamSuspected        bool
+	LowInventoryAlerted bool
+}
+
+func telemetryKey(c context.Context, dispenser string) *datastore.Key {
+	return datastore.NewKey(c, "telemetry", strings.ToLower(dispenser), 0, nil)
+}
+
+func loadTelemetry(c context.Context, dispenser string) (Telemetry, error) {
+	t := Telemetry{Dispenser: dispenser}
+	err := datastore.Get(c, telemetryKey(c, dispenser), &t)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return t, err
+}
+
+// RemainingFraction estimates how full the dispenser is from how long the
+// motor has run since it was refilled, or -1 if the capacity isn't known.
+func (t Telemetry) RemainingFraction(d Dispenser) float64 {
+	if d.Capacity <= 0 {
+		return -1
+	}
+	remaining := 1 - t.MotorSecondsSinceRefill/d.Capacity.Seconds()
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// RemainingPercent is RemainingFraction for templates.
+func (t Telemetry) RemainingPercent(d Dispenser) int {
+	return int(100 * t.RemainingFraction(d))
+}
+
+// replayed returns whether a report has been accepted before.  The agent's
+// sequence restarts with it, so reports are identified by their timestamp
+// too.  If the window is full, reports older than all of it can't be told
+// apart from replays.
+func (t Telemetry) replayed(report TelemetryReport) bool {
+	for i, ts := range t.SeenTimestamps {
+		if ts == report.Timestamp && t.SeenSequences[i] == report.Sequence {
+			return true
+		}
+	}
+	return len(t.SeenTimestamps) >= telemetryWindow && report.Timestamp < t.SeenTimestamps[t.oldestSeen()]
+}
+
+func (t Telemetry) oldestSeen() int {
+	oldest := 0
+	for i, ts := range t.SeenTimestamps {
+		if ts < t.SeenTimestamps[oldest] {
+			oldest = i
+		}
+	}
+	return oldest
+}
+
+// see remembers a report, forgetting those that are too old to be accepted
+// anyway and the oldest if there are too many.
+func (t *Telemetry) see(report TelemetryReport, now time.Time) {
+	t.SeenTimestamps = append(t.SeenTimestamps, report.Timestamp)
+	t.SeenSequences = append(t.SeenSequences, report.Sequence)
+	stale := now.Add(-maxTelemetrySkew).Unix()
+	for len(t.SeenTimestamps) > 0 {
+		i := t.oldestSeen()
+		if t.SeenTimestamps[i] >= stale && len(t.SeenTimestamps) <= telemetryWindow {
+			break
+		}
+		t.SeenTimestamps = append(t.SeenTimestamps[:i], t.SeenTimestamps[i+1:]...)
+		t.SeenSequences = append(t.SeenSequences[:i], t.SeenSequences[i+1:]...)
+	}
+}
+
+var errReplayedTelemetry = errors.New("telemetry report replayed")
+
+// apply updates the telemetry with a report and returns whether a jam is
+// newly suspected and whether inventory just became low.
+func (t *Telemetry) apply(report TelemetryReport, d Dispenser, now time.Time) (jam, low bool) {
+	t.LastReport = now
+	t.see(report, now)
+	t.RSSI = report.RSSI
+	switch report.Event {
+	case "boot":
+		t.LastBoot = now
+	case "dispense":
+		t.TotalMotorSeconds += report.MotorSeconds
+		t.MotorSecondsSinceRefill += report.MotorSeconds
+		if report.Drops == 0 {
+			t.MissedDrops++
+		} else if report.Drops > 0 {
+			t.MissedDrops = 0
+			t.JamSuspected = false
+		}
+	}
+	if t.MissedDrops >= jamThreshold && !t.JamSuspected {
+		t.JamSuspected = true
+		jam = true
+	}
+	if remaining := t.RemainingFraction(d); remaining >= 0 && remaining < lowInventoryFraction &&
+		!t.LowInventoryAlerted {
+		t.LowInventoryAlerted = true
+		low = true
+	}
+	return jam, low
+}
+
+// findDispenserByAgent returns the dispenser driven by the agent at agentURL.
+func (cfg Configuration) findDispenserByAgent(agentURL string) (Dispenser, bool) {
+	for _, d := range cfg.Dispensers {
+		if strings.TrimRight(d.AgentURL, "/") == strings.TrimRight(agentURL, "/") {
+			return d, true
+		}
+	}
+	return Dispenser{}, false
+}
+
+func HandleTelemetry(w http.ResponseWriter, r *http.Request, c context.Context) {
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf(c, "Can't read request body: %v", err)
+		http.Error(w, "Can't read request body", http.StatusBadRequest)
+		return
+	}
+	var report TelemetryReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		log.Errorf(c, "Failed to decode telemetry: %v\n%s", err, body)
+		http.Error(w, "Bad payload", http.StatusBadRequest)
+		return
+	}
+
+	d, ok := cfg.findDispenserByAgent(report.AgentURL)
+	if !ok {
+		log.Errorf(c, "Telemetry from unknown agent %q", report.AgentURL)
+		http.Error(w, "Unknown agent", http.StatusUnauthorized)
+		return
+	}
+	if d.AgentSecret == "" {
+		log.Errorf(c, "Telemetry from %q, which has no agent secret", d.Name)
+		http.Error(w, "Unknown agent", http.StatusUnauthorized)
+		return
+	}
+	sig := snackbot.SignBody(d.AgentSecret, body)
+	if !hmac.Equal([]byte(sig), []byte(r.Header.Get(snackbot.SignatureHeader))) {
+		log.Errorf(c, "Bad telemetry signature from %q", d.Name)
+		http.Error(w, "Bad signature", http.StatusUnauthorized)
+		return
+	}
+	if skew := time.Since(time.Unix(report.Timestamp, 0)); skew > maxTelemetrySkew || skew < -maxTelemetrySkew {
+		log.Errorf(c, "Stale telemetry from %q: %v old", d.Name, skew)
+		http.Error(w, "Stale report", http.StatusBadRequest)
+		return
+	}
+
+	var t Telemetry
+	var jam, low bool
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		var err error
+		if t, err = loadTelemetry(c, d.Name); err != nil {
+			return err
+		}
+		if t.replayed(report) {
+			return errReplayedTelemetry
+		}
+		t.Dispenser = d.Name
+		jam, low = t.apply(report, d, time.Now())
+		_, err = datastore.Put(c, telemetryKey(c, d.Name), &t)
+		return err
+	}, nil)
+	if err == errReplayedTelemetry {
+		log.Errorf(c, "Replayed telemetry from %q: %#v", d.Name, report)
+		http.Error(w, "Replayed report", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Criticalf(c, "Failed to save telemetry for %q: %v", d.Name, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Debugf(c, "Telemetry from %q: %#v", d.Name, report)
+
+	if jam {
+		alertAdmins(c, fmt.Sprintf("%s may be jammed", d.Name), fmt.Sprintf(
+			"The last %d dispenses from %s (%s) didn't drop any candy.  It may be jammed or empty.\n\n"+
+				"Mark it refilled once it's fixed: http://%s/dispensers",
+			t.MissedDrops, d.Name, d.Location, r.Host))
+	}
+	if low {
+		alertAdmins(c, fmt.Sprintf("%s is running low", d.Name), fmt.Sprintf(
+			"%s (%s) is about %d%% full.  Please refill it and then mark it refilled:\n"+
+				"http://%s/dispensers",
+			d.Name, d.Location, t.RemainingPercent(d), r.Host))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func alertAdmins(c context.Context, subject, body string) {
+	msg := &mail.Message{
+		Sender:  fmt.Sprintf("Chompy <notify@%s.appspotmail.com>", appengine.AppID(c)),
+		Subject: subject,
+		Body:    body,
+	}
+	if err := mail.SendToAdmins(c, msg); err != nil {
+		log.Errorf(c, "Couldn't send admin alert %q: %v", subject, err)
+		return
+	}
+	log.Warningf(c, "Alerted admins: %s", subject)
+}
+
+// DispenserHealth is everything we know about a dispenser for the admin page.
+type DispenserHealth struct {
+	Dispenser Dispenser
+	Status    DispenserStatus
+	Telemetry Telemetry
+}
+
+func ShowDispensers(w http.ResponseWriter, r *http.Request, c context.Context) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	statuses := dispenserStatuses(c, cfg.Dispensers)
+	var dispensers []DispenserHealth
+	for i, d := range cfg.Dispensers {
+		t, err := loadTelemetry(c, d.Name)
+		if err != nil {
+			log.Errorf(c, "Failed to load telemetry for %q: %v", d.Name, err)
+		}
+		dispensers = append(dispensers, DispenserHealth{d, statuses[i], t})
+	}
+	params := struct {
+		Problems   []string
+		Dispensers []DispenserHealth
+	}{cfg.dispenserProblems(), dispensers}
+	if err := dispensersHtmlTpl.Execute(w, params); err != nil {
+		log.Criticalf(c, "Failed to render dispensers page: %v", err)
+	}
+}
+
+// RefillDispenser resets a dispenser's inventory estimate and jam detection.
+func RefillDispenser(w http.ResponseWriter, r *http.Request, c context.Context, p martini.Params) {
+	u := user.Current(c)
+	if u == nil || !u.Admin {
+		http.NotFound(w, r)
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+	d, err := cfg.Dispenser(p["name"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		t, err := loadTelemetry(c, d.Name)
+		if err != nil {
+			return err
+		}
+		t.Dispenser = d.Name
+		t.Refilled = time.Now()
+		t.MotorSecondsSinceRefill = 0
+		t.MissedDrops = 0
+		t.JamSuspected = false
+		t.LowInventoryAlerted = false
+		_, err = datastore.Put(c, telemetryKey(c, d.Name), &t)
+		return err
+	}, nil)
+	if err != nil {
+		log.Criticalf(c, "Failed to mark %q refilled: %v", d.Name, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(c, "%q refilled %q", u.Email, d.Name)
+	http.Redirect(w, r, "/dispensers", http.StatusSeeOther)
+}
@@ -0,0 +1,96 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTelemetryApply(t *testing.T) {
+	d := Dispenser{Name: "snackman", Capacity: 10 * time.Second}
+	now := time.Now()
+	var tel Telemetry
+
+	dispense := func(seconds float64, drops int) (jam, low bool) {
+		return tel.apply(TelemetryReport{Event: "dispense", MotorSeconds: seconds, Drops: drops}, d, now)
+	}
+
+	if jam, low := dispense(4, 3); jam || low {
+		t.Errorf("First dispense: jam=%v low=%v", jam, low)
+	}
+	if got := tel.RemainingPercent(d); got != 60 {
+		t.Errorf("Remaining after 4s: %d%%, want 60%%", got)
+	}
+
+	if jam, _ := dispense(1, 0); jam {
+		t.Errorf("One empty dispense shouldn't be a jam")
+	}
+	if jam, _ := dispense(1, 0); !jam {
+		t.Errorf("Two empty dispenses should be a suspected jam")
+	}
+	if jam, _ := dispense(1, 0); jam {
+		t.Errorf("Jam should only be reported once")
+	}
+	if dispense(1, 2); tel.JamSuspected || tel.MissedDrops != 0 {
+		t.Errorf("Candy dropping should clear the jam: %+v", tel)
+	}
+
+	if _, low := dispense(1, -1); !low {
+		t.Errorf("Should be low at %d%%", tel.RemainingPercent(d))
+	}
+	if _, low := dispense(1, -1); low {
+		t.Errorf("Low inventory should only be reported once")
+	}
+	if got := tel.RemainingPercent(d); got != 0 {
+		t.Errorf("Remaining after overrunning capacity: %d%%, want 0%%", got)
+	}
+
+	if got := tel.RemainingFraction(Dispenser{}); got != -1 {
+		t.Errorf("Unknown capacity should give -1, got %v", got)
+	}
+}
+
+func TestTelemetryReplayed(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var tel Telemetry
+	for _, seq := range []int64{5, 7} {
+		tel.apply(TelemetryReport{Event: "boot", Timestamp: 1000, Sequence: seq}, Dispenser{}, now)
+	}
+	for _, test := range []struct {
+		timestamp, sequence int64
+		replayed            bool
+	}{
+		{1000, 5, true},
+		{1000, 7, true},
+		{1000, 6, false}, // sent before 7 but arrived after it
+		{999, 4, false},
+		{1001, 1, false}, // the agent restarted
+	} {
+		report := TelemetryReport{Timestamp: test.timestamp, Sequence: test.sequence}
+		if got := tel.replayed(report); got != test.replayed {
+			t.Errorf("Report %d/%d after 1000/5 and 1000/7: replayed=%v, want %v",
+				test.timestamp, test.sequence, got, test.replayed)
+		}
+	}
+
+	// Reports too old to be accepted anyway are forgotten.
+	later := now.Add(maxTelemetrySkew + time.Second)
+	tel.apply(TelemetryReport{Event: "boot", Timestamp: later.Unix(), Sequence: 8}, Dispenser{}, later)
+	if len(tel.SeenTimestamps) != 1 || len(tel.SeenSequences) != 1 {
+		t.Errorf("Stale reports should be forgotten: %+v", tel)
+	}
+	if !tel.replayed(TelemetryReport{Timestamp: later.Unix(), Sequence: 8}) {
+		t.Errorf("Applied report should not be accepted again: %+v", tel)
+	}
+
+	// Once the window is full, only reports newer than all of it are accepted.
+	for seq := int64(9); len(tel.SeenTimestamps) < telemetryWindow; seq++ {
+		tel.apply(TelemetryReport{Event: "boot", Timestamp: later.Unix() + seq, Sequence: seq}, Dispenser{}, later)
+	}
+	tel.apply(TelemetryReport{Event: "boot", Timestamp: later.Unix() + 1000, Sequence: 1000}, Dispenser{}, later)
+	if len(tel.SeenTimestamps) != telemetryWindow {
+		t.Errorf("Remembered %d reports, want %d", len(tel.SeenTimestamps), telemetryWindow)
+	}
+	if !tel.replayed(TelemetryReport{Timestamp: later.Unix(), Sequence: 8}) {
+		t.Errorf("Forgotten report older than the window should count as replayed")
+	}
+}
@@ -0,0 +1,273 @@
+package chompy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+const (
+	// Cron polls the dispensers every minute (see cron.yaml).  Cached
+	// statuses older than this are checked live instead, e.g. when cron
+	// isn't running.
+	maxStatusAge = 5 * time.Minute
+	// Admins are emailed when a dispenser has been offline this long.
+	offlineAlertAfter = 15 * time.Minute
+	// How far back the uptime page looks.
+	uptimeWindow = 7 * 24 * time.Hour
+)
+
+// DispenserState is the last polled status of a dispenser.
+type DispenserState struct {
+	Dispenser      string
+	Online         bool
+	Error          string `datastore:",noindex"`
+	Checked        time.Time
+	Since          time.Time // when Online last changed
+	OfflineAlerted bool
+}
+
+// UptimeEvent records a dispenser going online or offline.
+type UptimeEvent struct {
+	Dispenser string
+	Online    bool
+	Time      time.Time
+	Error     string `datastore:",noindex"`
+}
+
+func dispenserStateKey(c context.Context, dispenser string) *datastore.Key {
+	return datastore.NewKey(c, "dispenser_state", strings.ToLower(dispenser), 0, nil)
+}
+
+// update applies a freshly polled status.  It returns whether the dispenser
+// went online or offline, and whether admins should be told that it's been
+// offline too long or that it's back.
+func (s *DispenserState) update(status DispenserStatus, now time.Time) (changed, alertOffline, alertOnline bool) {
+	changed = s.Checked.IsZero() || s.Online != status.Online
+	if changed {
+		s.Since = now
+	}
+	s.Online = status.Online
+	s.Error = status.Error
+	s.Checked = now
+
+	switch {
+	case s.Online && s.OfflineAlerted:
+		s.OfflineAlerted = false
+		alertOnline = true
+	case !s.Online && !s.OfflineAlerted && now.Sub(s.Since) >= offlineAlertAfter:
+		s.OfflineAlerted = true
+		alertOffline = true
+	}
+	return changed, alertOffline, alertOnline
+}
+
+func (s DispenserState) status(d Dispenser) DispenserStatus {
+	return DispenserStatus{Name: d.Name, Location: d.Location, Online: s.Online, Error: s.Error,
+		RequiresPresence: d.RequirePresence}
+}
+
+// cachedDispenserStatuses returns the polled status of each dispenser,
+// checking live any that haven't been polled recently.
+func cachedDispenserStatuses(c context.Context, dispensers []Dispenser) []DispenserStatus {
+	keys := make([]*datastore.Key, len(dispensers))
+	for i, d := range dispensers {
+		keys[i] = dispenserStateKey(c, d.Name)
+	}
+	states := make([]DispenserState, len(dispensers))
+	errs := make([]error, len(dispensers))
+	if err := datastore.GetMulti(c, keys, states); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			errs = me
+		} else {
+			for i := range errs {
+				errs[i] = err
+			}
+		}
+	}
+
+	statuses := make([]DispenserStatus, len(dispensers))
+	var stale []Dispenser
+	var staleIdx []int
+	for i, d := range dispensers {
+		if errs[i] != nil || time.Since(states[i].Checked) > maxStatusAge {
+			if errs[i] != nil && errs[i] != datastore.ErrNoSuchEntity {
+				log.Errorf(c, "Failed to load cached status of %q: %v", d.Name, errs[i])
+			}
+			stale = append(stale, d)
+			staleIdx = append(staleIdx, i)
+			continue
+		}
+		statuses[i] = states[i].status(d)
+	}
+	for i, status := range dispenserStatuses(c, stale) {
+		statuses[staleIdx[i]] = status
+	}
+	return statuses
+}
+
+// PollStatus is run by cron to check every dispenser, record when they go
+// online or offline, alert admins about long outages and let people with
+// queued dispenses know when their dispenser is back.
+func PollStatus(w http.ResponseWriter, r *http.Request, c context.Context) {
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		if u := user.Current(c); u == nil || !u.Admin {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	statuses := dispenserStatuses(c, cfg.Dispensers)
+	for i, d := range cfg.Dispensers {
+		if err := recordStatus(c, d, statuses[i], r.Host); err != nil {
+			log.Criticalf(c, "Failed to record status of %q: %v", d.Name, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if statuses[i].Online {
+			if err := processDispenseQueue(c, d, r.Host); err != nil {
+				log.Criticalf(c, "Failed to process dispense queue of %q: %v", d.Name, err)
+			}
+		}
+	}
+	if err := expireDispenseQueue(c); err != nil {
+		log.Criticalf(c, "Failed to expire queued dispenses: %v", err)
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func recordStatus(c context.Context, d Dispenser, status DispenserStatus, host string) error {
+	var state DispenserState
+	var changed, alertOffline, alertOnline bool
+	now := time.Now()
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		key := dispenserStateKey(c, d.Name)
+		state = DispenserState{}
+		if err := datastore.Get(c, key, &state); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		state.Dispenser = d.Name
+		changed, alertOffline, alertOnline = state.update(status, now)
+		_, err := datastore.Put(c, key, &state)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		log.Infof(c, "Dispenser %q is now online=%v (%s)", d.Name, status.Online, status.Error)
+		event := &UptimeEvent{Dispenser: d.Name, Online: status.Online, Time: now, Error: status.Error}
+		if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, "uptime_events", nil), event); err != nil {
+			return err
+		}
+	}
+	if alertOffline {
+		alertAdmins(c, fmt.Sprintf("%s is offline", d.Name), fmt.Sprintf(
+			"%s (%s) has been offline since %s: %s\n\nUptime history: http://%s/uptime",
+			d.Name, d.Location, state.Since.Format(time.RFC1123), status.Error, host))
+	}
+	if alertOnline {
+		alertAdmins(c, fmt.Sprintf("%s is back online", d.Name), fmt.Sprintf(
+			"%s (%s) is back online.\n\nUptime history: http://%s/uptime", d.Name, d.Location, host))
+	}
+	return nil
+}
+
+// uptimeFraction returns the fraction of [since, now) during which the
+// dispenser was online, given the events in that window (oldest first) and
+// whether it is online now.
+func uptimeFraction(events []UptimeEvent, online bool, since, now time.Time) float64 {
+	if !now.After(since) {
+		return 0
+	}
+	var up time.Duration
+	// Before the first event, the dispenser was in the opposite state.
+	wasOnline, from := online, since
+	if len(events) > 0 {
+		wasOnline = !events[0].Online
+	}
+	for _, e := range events {
+		if wasOnline {
+			up += e.Time.Sub(from)
+		}
+		wasOnline, from = e.Online, e.Time
+	}
+	if wasOnline {
+		up += now.Sub(from)
+	}
+	return float64(up) / float64(now.Sub(since))
+}
+
+// Uptime is a dispenser's recent availability for the uptime page.
+type Uptime struct {
+	Dispenser     Dispenser
+	State         DispenserState
+	Day, Week     float64 // percentage online
+	RecentlyFirst []UptimeEvent
+}
+
+func ShowUptime(w http.ResponseWriter, r *http.Request, c context.Context) {
+	if user.Current(c) == nil {
+		url, _ := user.LoginURL(c, r.URL.String())
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+	cfg, err := getConfig(c)
+	if err != nil {
+		log.Criticalf(c, "Cannot load configuration: %v", err)
+		http.Error(w, "Cannot load configuration", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	var uptimes []Uptime
+	for _, d := range cfg.Dispensers {
+		u := Uptime{Dispenser: d}
+		err := datastore.Get(c, dispenserStateKey(c, d.Name), &u.State)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			log.Criticalf(c, "Failed to load status of %q: %v", d.Name, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		var events []UptimeEvent
+		_, err = datastore.NewQuery("uptime_events").
+			Filter("Dispenser =", d.Name).
+			Filter("Time >=", now.Add(-uptimeWindow)).
+			Order("Time").
+			GetAll(c, &events)
+		if err != nil {
+			log.Criticalf(c, "Failed to load uptime of %q: %v", d.Name, err)
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		u.Week = 100 * uptimeFraction(events, u.State.Online, now.Add(-uptimeWindow), now)
+		dayStart := now.Add(-24 * time.Hour)
+		dayIdx := sort.Search(len(events), func(i int) bool { return !events[i].Time.Before(dayStart) })
+		u.Day = 100 * uptimeFraction(events[dayIdx:], u.State.Online, dayStart, now)
+		for i := len(events) - 1; i >= 0; i-- {
+			u.RecentlyFirst = append(u.RecentlyFirst, events[i])
+		}
+		uptimes = append(uptimes, u)
+	}
+
+	if err := uptimeHtmlTpl.Execute(w, uptimes); err != nil {
+		log.Criticalf(c, "Failed to render uptime template: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package chompy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUptimeFraction(t *testing.T) {
+	since := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	now := since.Add(10 * time.Hour)
+	at := func(h int) time.Time { return since.Add(time.Duration(h) * time.Hour) }
+
+	testCases := []struct {
+		name   string
+		events []UptimeEvent
+		online bool
+		want   float64
+	}{
+		{"always up", nil, true, 1},
+		{"always down", nil, false, 0},
+		{"went down", []UptimeEvent{{Online: false, Time: at(4)}}, false, 0.4},
+		{"came back", []UptimeEvent{{Online: true, Time: at(4)}}, true, 0.6},
+		{"blip", []UptimeEvent{{Online: false, Time: at(2)}, {Online: true, Time: at(3)}}, true, 0.9},
+	}
+	for _, tc := range testCases {
+		if got := uptimeFraction(tc.events, tc.online, since, now); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDispenserStateAlerts(t *testing.T) {
+	start := time.Now()
+	var s DispenserState
+
+	if changed, down, up := s.update(DispenserStatus{Online: true}, start); !changed || down || up {
+		t.Errorf("First poll: changed=%v down=%v up=%v", changed, down, up)
+	}
+	if changed, down, _ := s.update(DispenserStatus{Online: false}, start.Add(time.Minute)); !changed || down {
+		t.Errorf("Going offline: changed=%v down=%v", changed, down)
+	}
+	if _, down, _ := s.update(DispenserStatus{Online: false}, start.Add(time.Minute+offlineAlertAfter)); !down {
+		t.Errorf("Should alert after being offline for %v", offlineAlertAfter)
+	}
+	if _, down, _ := s.update(DispenserStatus{Online: false}, start.Add(time.Hour)); down {
+		t.Errorf("Should only alert once per outage")
+	}
+	if changed, _, up := s.update(DispenserStatus{Online: true}, start.Add(2*time.Hour)); !changed || !up {
+		t.Errorf("Coming back: changed=%v up=%v", changed, up)
+	}
+}
@@ -23,10 +23,13 @@ func HandleWebhook(w http.ResponseWriter, r *http.Request, c context.Context) {
 		return
 	}
 
+	rec := &statusRecorder{ResponseWriter: w}
 	if strings.HasPrefix(r.Header.Get("User-Agent"), "GitHub-Hookshot/") {
-		handleGithubWebhook(w, r, c, cfg)
+		handleGithubWebhook(rec, r, c, cfg)
+		metricWebhooks.WithLabelValues("github", githubEventLabel(r.Header.Get("X-GitHub-Event")), rec.Outcome()).Inc()
 	} else {
-		handleGenericWebhook(w, r, c, cfg)
+		handleGenericWebhook(rec, r, c, cfg)
+		metricWebhooks.WithLabelValues("generic", "", rec.Outcome()).Inc()
 	}
 }
 
@@ -38,12 +41,14 @@ func handleGenericWebhook(w http.ResponseWriter, r *http.Request, c context.Cont
 		return
 	}
 
-	log.Infof(c, "Got request body: %s", body)
+	_, logged := withAuth("", body, redactedSecret)
+	log.Infof(c, "Got request body: %s", logged)
 
 	var payload struct {
 		Auth        string
 		Description string
 		Email       string
+		Team        string // grants to the team's pool instead of Email
 		Type        string
 	}
 
@@ -53,20 +58,28 @@ func handleGenericWebhook(w http.ResponseWriter, r *http.Request, c context.Cont
 		return
 	}
 
-	if payload.Auth != cfg.SecretAuthToken {
-		log.Errorf(c, "Bad auth code: %q", payload.Auth)
+	valid := cfg.validAuth(payload.Auth)
+	noteSignature(c, valid)
+	if !valid {
+		log.Errorf(c, "Bad auth code")
 		http.Error(w, "Bad auth code", http.StatusUnauthorized)
 		return
 	}
 
-	if payload.Email == "" || payload.Description == "" || payload.Type == "" {
+	if (payload.Email == "" && payload.Team == "") || payload.Description == "" || payload.Type == "" {
 		log.Errorf(c, "Missing required fields: %#v", payload)
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
 
-	log.Infof(c, "Valid request, granting credit to %q for %q", payload.Email, payload.Description)
-	code, err := grantReward(c, r, payload.Email, payload.Type, payload.Description)
+	var code int
+	if payload.Team != "" {
+		log.Infof(c, "Valid request, granting credit to team %q for %q", payload.Team, payload.Description)
+		code, err = grantTeamReward(c, r, payload.Team, payload.Type, payload.Description)
+	} else {
+		log.Infof(c, "Valid request, granting credit to %q for %q", payload.Email, payload.Description)
+		code, err = grantReward(c, r, payload.Email, payload.Type, payload.Description)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), code)
 		return
@@ -76,7 +89,7 @@ func handleGenericWebhook(w http.ResponseWriter, r *http.Request, c context.Cont
 }
 
 func handleGithubWebhook(w http.ResponseWriter, r *http.Request, c context.Context, cfg Configuration) {
-	(&GithubWebhookRequest{w, r, c, cfg.SecretAuthToken, cfg.GithubUsers}).Handle()
+	(&GithubWebhookRequest{w, r, c, cfg.SecretAuthToken, cfg.GithubUsers, cfg, GithubRepo{}}).Handle()
 }
 
 func validateGithubWebhook(payload []byte, key, sig string) error {
@@ -97,6 +110,8 @@ type GithubWebhookRequest struct {
 
 	SecretAuthToken string
 	Users           []GithubUserInfo
+	Config          Configuration
+	Repo            GithubRepo // settings for the repository the event is from
 }
 
 func (g *GithubWebhookRequest) LookGithubUser(username string) *GithubUserInfo {
@@ -118,7 +133,12 @@ func (g *GithubWebhookRequest) Handle() {
 		return
 	}
 
-	if err := validateGithubWebhook(body, g.SecretAuthToken, g.r.Header.Get("X-Hub-Signature")); err != nil {
+	// Repositories may have their own secret, so find out which one this is
+	// about before checking the signature.
+	g.Repo = g.Config.githubRepo(githubRepoName(body))
+	err = validateGithubWebhook(body, g.Repo.secret(g.SecretAuthToken), g.r.Header.Get("X-Hub-Signature"))
+	noteSignature(g.c, err == nil)
+	if err != nil {
 		log.Errorf(g.c, "Bad webhook signature: %v", err)
 		http.Error(g.w, "Bad signature", http.StatusBadRequest)
 		return
@@ -134,6 +154,10 @@ func (g *GithubWebhookRequest) Handle() {
 		g.HandlePullRequest(body)
 	case "pull_request_review":
 		g.HandlePullRequestReview(body)
+	case "pull_request_review_comment":
+		g.HandlePullRequestReviewComment(body)
+	case "workflow_run":
+		g.HandleWorkflowRun(body)
 	default:
 		g.w.WriteHeader(http.StatusNoContent)
 	}
@@ -141,6 +165,11 @@ func (g *GithubWebhookRequest) Handle() {
 }
 
 func (g *GithubWebhookRequest) Grant(githubUserName, typ, desc string) {
+	if !g.Repo.rewards(typ) {
+		log.Infof(g.c, "%s isn't rewarded for %q", typ, g.Repo.Name)
+		g.w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	user := g.LookGithubUser(githubUserName)
 	if user == nil {
 		log.Errorf(g.c, "Github username %q not configured.", githubUserName)
@@ -148,7 +177,7 @@ func (g *GithubWebhookRequest) Grant(githubUserName, typ, desc string) {
 		return
 	}
 
-	if code, err := grantReward(g.c, g.r, user.Email, typ, desc); err != nil {
+	if code, err := grantRewards(g.c, g.r, user.Email, typ, desc, g.Repo.credits()); err != nil {
 		http.Error(g.w, err.Error(), code)
 		return
 	}
@@ -184,11 +213,20 @@ func (g *GithubWebhookRequest) HandlePullRequest(body []byte) {
 	type EventData struct {
 		Action      string
 		PullRequest struct {
-			HtmlUrl string `json:"html_url"`
-			Number  int
-			Merged  bool
-			User    struct{ Login string }
+			HtmlUrl   string `json:"html_url"`
+			Number    int
+			Merged    bool
+			Body      string
+			User      struct{ Login, Type string }
+			MergedBy  struct{ Login string } `json:"merged_by"`
+			Additions int
+			Deletions int
+			Base      struct{ Ref string }
+			Labels    []struct{ Name string }
 		} `json:"pull_request"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		}
 	}
 	var eventData EventData
 	if err := json.Unmarshal(body, &eventData); err != nil {
@@ -204,15 +242,60 @@ func (g *GithubWebhookRequest) HandlePullRequest(body []byte) {
 		return
 	}
 
-	g.Grant(eventData.PullRequest.User.Login, "pull-request-merged", eventData.PullRequest.HtmlUrl)
+	pr := eventData.PullRequest
+	var labels []string
+	for _, label := range pr.Labels {
+		labels = append(labels, label.Name)
+	}
+	why := g.Config.githubExcluded(eventData.Repository.FullName, pr.Base.Ref, labels)
+	if why == "" && !g.Repo.branchAllowed(pr.Base.Ref) {
+		why = fmt.Sprintf("branch %s doesn't count for %q", pr.Base.Ref, g.Repo.Name)
+	}
+	if why != "" {
+		log.Infof(g.c, "Ignoring %s: %s", pr.HtmlUrl, why)
+		g.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if reverted := revertedPullRequest(pr.Body); reverted != "" {
+		if err := penalizeRevert(g.c, g.Config, reverted); err != nil {
+			log.Criticalf(g.c, "Failed to penalize revert of %s: %v", reverted, err)
+		}
+	}
+
+	g.creditReviews(pr.HtmlUrl, pr.User.Login, pr.Additions+pr.Deletions)
+
+	if g.Config.isGithubBot(pr.User.Login, pr.User.Type) {
+		log.Infof(g.c, "Not crediting bot %q for %s", pr.User.Login, pr.HtmlUrl)
+		g.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if g.Config.GithubRequireApproval {
+		approved, err := hasApproval(g.c, pr.HtmlUrl)
+		if err != nil {
+			log.Criticalf(g.c, "Failed to load reviews of %s: %v", pr.HtmlUrl, err)
+			http.Error(g.w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if !approved {
+			log.Infof(g.c, "Not crediting %q for unapproved %s (merged by %q)",
+				pr.User.Login, pr.HtmlUrl, pr.MergedBy.Login)
+			g.w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	g.Grant(pr.User.Login, "pull-request-merged", pr.HtmlUrl)
 }
 
 func (g *GithubWebhookRequest) HandlePullRequestReview(body []byte) {
 	type EventData struct {
 		Action string
 		Review struct {
-			User  struct{ Login string }
+			Id    int64
+			User  struct{ Login, Type string }
 			State string
+			Body  string
 		}
 		PullRequest struct {
 			HtmlUrl  string `json:"html_url"`
@@ -231,10 +314,72 @@ func (g *GithubWebhookRequest) HandlePullRequestReview(body []byte) {
 	log.Debugf(g.c, "Review Action: %q  state: %q  merged-at: %v",
 		eventData.Action, eventData.Review.State, eventData.PullRequest.MergedAt)
 
-	if eventData.Action != "submitted" || eventData.Review.State != "approved" || !eventData.PullRequest.MergedAt.IsZero() {
+	reviewer := eventData.Review.User.Login
+	if !eventData.PullRequest.MergedAt.IsZero() || strings.EqualFold(reviewer, eventData.PullRequest.User.Login) ||
+		g.Config.isGithubBot(reviewer, eventData.Review.User.Type) {
+		g.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Reviewers are credited when the pull request is merged.
+	var update func(*ReviewRecord)
+	switch eventData.Action {
+	case "submitted":
+		update = func(rev *ReviewRecord) {
+			if eventData.Review.State == "approved" {
+				rev.Approved = true
+			}
+			if strings.TrimSpace(eventData.Review.Body) != "" {
+				rev.countComment(eventData.Review.Id)
+			}
+		}
+	case "dismissed":
+		update = func(rev *ReviewRecord) { rev.Approved = false }
+	default:
 		g.w.WriteHeader(http.StatusNoContent)
 		return
 	}
+	if err := updateReview(g.c, eventData.PullRequest.HtmlUrl, reviewer, update); err != nil {
+		log.Criticalf(g.c, "Failed to record review of %s by %q: %v", eventData.PullRequest.HtmlUrl, reviewer, err)
+		http.Error(g.w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	g.w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *GithubWebhookRequest) HandlePullRequestReviewComment(body []byte) {
+	type EventData struct {
+		Action  string
+		Comment struct {
+			Id   int64
+			User struct{ Login, Type string }
+		}
+		PullRequest struct {
+			HtmlUrl string `json:"html_url"`
+			User    struct{ Login string }
+		} `json:"pull_request"`
+	}
+	var eventData EventData
+	if err := json.Unmarshal(body, &eventData); err != nil {
+		log.Criticalf(g.c, "Cannot parse json payload: %v", err)
+		http.Error(g.w, "Can't parse JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Debugf(g.c, "Parsed JSON: %#v", eventData)
 
-	g.Grant(eventData.Review.User.Login, "pull-request-reviewed", eventData.PullRequest.HtmlUrl)
+	reviewer := eventData.Comment.User.Login
+	if eventData.Action != "created" || strings.EqualFold(reviewer, eventData.PullRequest.User.Login) ||
+		g.Config.isGithubBot(reviewer, eventData.Comment.User.Type) {
+		g.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	err := updateReview(g.c, eventData.PullRequest.HtmlUrl, reviewer, func(rev *ReviewRecord) {
+		rev.countComment(eventData.Comment.Id)
+	})
+	if err != nil {
+		log.Criticalf(g.c, "Failed to record review comment on %s by %q: %v", eventData.PullRequest.HtmlUrl, reviewer, err)
+		http.Error(g.w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	g.w.WriteHeader(http.StatusNoContent)
 }